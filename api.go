@@ -1,42 +1,208 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"mime"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
 type APIServer struct {
-	store Storage
+	store   Storage
+	metrics *Metrics
+	tracer  *Tracer
+	logger  *slog.Logger
+
+	// requestTimeout is the deadline budget given to storage calls of one request
+	requestTimeout time.Duration
+
+	// maxAmount bounds the amount of one transaction, 0 for no limit
+	maxAmount float64
+
+	// rateLimits and quotas bound what sources and users may send
+	rateLimits RateLimitConfig
+	quotas     QuotaConfig
+
+	// legacySunset is announced on the unversioned paths as the date they go away
+	legacySunset time.Time
+
+	// queue serializes transactions per user, nil when disabled
+	queue *userQueue
+
+	// webhooks manages partner callbacks, nil when disabled
+	webhooks *WebhookService
+
+	// stream feeds the balance event streams, nil when disabled
+	stream *BalanceHub
+
+	// sockets serves the provider transaction socket, nil when disabled
+	sockets *socketGateway
+
+	// service holds the business rules, built from the fields above
+	service *BalanceService
 }
 
-func NewAPIServer(store Storage) *APIServer {
-	return &APIServer{
-		store: store,
+// defaultRequestTimeout is used when no WithRequestTimeout option is given
+const defaultRequestTimeout = 5 * time.Second
+
+// ServerOption customizes an APIServer
+type ServerOption func(*APIServer)
+
+// WithTracer sets the tracer used for request and storage spans
+func WithTracer(tracer *Tracer) ServerOption {
+	return func(s *APIServer) {
+		s.tracer = tracer
 	}
 }
 
-func (s *APIServer) Run(addr string) {
-	router := mux.NewRouter()
+// WithLogger sets the logger used for access logs and handler errors
+func WithLogger(logger *slog.Logger) ServerOption {
+	return func(s *APIServer) {
+		s.logger = logger
+	}
+}
 
-	router.HandleFunc("/user/{userId}/transaction", s.HandleTransaction).Methods("POST")
-	router.HandleFunc("/user/{userId}/balance", s.HandleGetBalance).Methods("GET")
-	router.HandleFunc("/health", s.HandleHealth).Methods("GET")
+// WithRequestTimeout sets the per-request deadline for storage calls
+func WithRequestTimeout(timeout time.Duration) ServerOption {
+	return func(s *APIServer) {
+		s.requestTimeout = timeout
+	}
+}
 
-	log.Printf("Server running on %s", addr)
+// WithMaxAmount sets the largest amount a transaction may carry, 0 for no limit
+func WithMaxAmount(amount float64) ServerOption {
+	return func(s *APIServer) {
+		s.maxAmount = amount
+	}
+}
+
+// WithLegacySunset sets the Sunset date announced on the unversioned paths
+func WithLegacySunset(sunset time.Time) ServerOption {
+	return func(s *APIServer) {
+		s.legacySunset = sunset
+	}
+}
+
+// WithRateLimits sets the token buckets limiting transactions per Source-Type and per user
+func WithRateLimits(cfg RateLimitConfig) ServerOption {
+	return func(s *APIServer) {
+		s.rateLimits = cfg
+	}
+}
+
+// WithDailyQuotas sets the daily count and amount allowed per Source-Type
+func WithDailyQuotas(cfg QuotaConfig) ServerOption {
+	return func(s *APIServer) {
+		s.quotas = cfg
+	}
+}
+
+// WithUserQueueDepth sets how many transactions of one user may be queued
+// before the server answers 429, 0 disables per-user queueing
+func WithUserQueueDepth(depth int) ServerOption {
+	return func(s *APIServer) {
+		s.queue = nil
+		if depth > 0 {
+			s.queue = newUserQueue(depth)
+		}
+	}
+}
+
+// WithWebhooks enables the webhook subscription endpoints and rejection events
+func WithWebhooks(webhooks *WebhookService) ServerOption {
+	return func(s *APIServer) {
+		s.webhooks = webhooks
+	}
+}
+
+// WithBalanceStream enables GET /user/{userId}/balance/stream fed by hub
+func WithBalanceStream(hub *BalanceHub) ServerOption {
+	return func(s *APIServer) {
+		s.stream = hub
+	}
+}
+
+// WithTransactionSocket enables the provider WebSocket at /transactions/ws
+func WithTransactionSocket(cfg SocketConfig) ServerOption {
+	return func(s *APIServer) {
+		s.sockets = newSocketGateway(cfg)
+	}
+}
+
+func NewAPIServer(store Storage, opts ...ServerOption) *APIServer {
+	s := &APIServer{
+		store:          store,
+		metrics:        NewMetrics(),
+		tracer:         NewTracer(nil),
+		logger:         slog.Default(),
+		requestTimeout: defaultRequestTimeout,
+		maxAmount:      defaultMaxAmount,
+		legacySunset:   defaultLegacySunset,
+		queue:          newUserQueue(defaultUserQueueDepth),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.service = &BalanceService{
+		store:     s.store,
+		maxAmount: s.maxAmount,
+		queue:     s.queue,
+		limits:    newLimits(s.rateLimits, s.quotas),
+		metrics:   s.metrics,
+		tracer:    s.tracer,
+		logger:    s.logger,
+		webhooks:  s.webhooks,
+	}
+	return s
+}
+
+// Service returns the service behind the handlers, for other transports to share
+func (s *APIServer) Service() *BalanceService {
+	return s.service
+}
+
+func (s *APIServer) Run(addr string) {
+	router := s.Router()
+
+	s.logger.Info("server running", "addr", addr)
 	if err := http.ListenAndServe(addr, router); err != nil {
-		log.Fatalf("Server failed: %v", err)
+		s.logger.Error("server failed", "error", err)
+		os.Exit(1)
 	}
 }
 
-func (s *APIServer) HandleHealth(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+// Router builds the HTTP router with every route and middleware registered
+func (s *APIServer) Router() *mux.Router {
+	router := mux.NewRouter()
+	router.Use(s.tracer.Middleware)
+	router.Use(LoggingMiddleware(s.logger))
+	router.Use(s.metrics.Middleware)
+
+	for _, version := range apiVersions {
+		s.registerAPI(router.PathPrefix(version.prefix).Subrouter(), version)
+	}
+	// the unversioned paths predate /v1 and answer like it until their sunset
+	legacy := router.NewRoute().Subrouter()
+	legacy.Use(s.deprecated(apiV1))
+	s.registerAPI(legacy, apiV1)
+
+	router.HandleFunc("/livez", s.HandleLivez).Methods("GET")
+	router.HandleFunc("/readyz", s.HandleReadyz).Methods("GET")
+	// kept for existing probes, same as /livez
+	router.HandleFunc("/health", s.HandleLivez).Methods("GET")
+	router.HandleFunc("/metrics", s.HandleMetrics).Methods("GET")
+
+	return router
 }
 
 // HandleTransaction processes POST /user/{userId}/transaction
@@ -49,81 +215,179 @@ func (s *APIServer) HandleTransaction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sourceType := r.Header.Get("Source-Type")
-	if sourceType == "" {
-		http.Error(w, "Missing Source-Type header", http.StatusBadRequest)
-		return
-	}
-
 	// Parse JSON body
-	var txReq TransactionRequest
-	if err := json.NewDecoder(r.Body).Decode(&txReq); err != nil {
-		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+	txReq, verr := versionOf(r).payloads.decodeTransaction(w, r)
+	if verr != nil {
+		writeValidationError(w, verr)
 		return
 	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+	defer cancel()
 
-	// Validate state
-	if txReq.State != "win" && txReq.State != "lose" {
-		http.Error(w, "Invalid state value", http.StatusBadRequest)
+	out := s.processTransaction(ctx, transactionCommand(userID, r.Header.Get("Source-Type"), txReq))
+	if out.Error != "" {
+		writeOutcomeError(w, out)
 		return
 	}
 
-	// Validate amount
-	amount, err := parseAmount(txReq.Amount)
-	if err != nil {
-		http.Error(w, "Invalid amount format", http.StatusBadRequest)
-		return
-	}
+	// res with success
+	w.WriteHeader(out.Code)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": out.Status,
+	})
+}
 
-	if !isValidAmount(txReq.Amount) {
-		http.Error(w, "Amount must have up to 2 decimal places", http.StatusBadRequest)
-		return
+// maxBodySize bounds JSON request bodies, a transaction takes about 100 bytes
+const maxBodySize = 4 << 10
+
+// errorCodeHeader carries the Code of a ValidationError next to its message
+const errorCodeHeader = "Error-Code"
+
+// limitJSONBody refuses requests not sent as JSON and bounds the body of the others
+func limitJSONBody(w http.ResponseWriter, r *http.Request) *ValidationError {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return invalid("Content-Type", "unsupported_media_type", "Content-Type must be application/json")
 	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	return nil
+}
 
-	// Check if transaction ID already exists
-	existingTx, err := s.store.GetTransactionByID(txReq.TransactionID)
-	if err == nil && existingTx != nil {
-		// Transaction already processed
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{
-			"status": "already processed",
-		})
-		return
+// decodeJSONBody decodes the body of r into dst, refusing unknown fields and
+// trailing data
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst any) *ValidationError {
+	if verr := limitJSONBody(w, r); verr != nil {
+		return verr
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return bodyError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return bodyError(err)
 	}
+	return nil
+}
 
-	// Determine balance delta
-	var delta float64
-	if txReq.State == "win" {
-		delta = amount
-	} else {
-		delta = -amount
+// bodyError explains why a request body couldn't be decoded
+func bodyError(err error) *ValidationError {
+	var tooLarge *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &tooLarge):
+		return invalid("body", "body_too_large", fmt.Sprintf("Request body must be at most %d bytes", tooLarge.Limit))
+	case errors.As(err, &typeErr):
+		return invalid(typeErr.Field, "invalid_type", fmt.Sprintf("%s must be a %s", typeErr.Field, typeErr.Type.Kind()))
+	}
+	// encoding/json has no error type for unknown fields
+	if field, ok := strings.CutPrefix(fmt.Sprint(err), "json: unknown field "); ok {
+		field = strings.Trim(field, `"`)
+		return invalid(field, "unknown_field", "Unknown field "+field)
 	}
+	return invalid("body", "invalid_json", "Invalid JSON body")
+}
 
-	err = s.store.UpdateUserBalance(userID, delta)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+// validationStatus is the HTTP status answering verr
+func validationStatus(verr *ValidationError) int {
+	switch verr.Code {
+	case "unsupported_media_type":
+		return http.StatusUnsupportedMediaType
+	case "body_too_large":
+		return http.StatusRequestEntityTooLarge
 	}
+	return http.StatusBadRequest
+}
 
-	// Record the transaction
-	tx := Transaction{
-		TransactionID: txReq.TransactionID,
+func writeValidationError(w http.ResponseWriter, verr *ValidationError) {
+	w.Header().Set(errorCodeHeader, verr.Code)
+	http.Error(w, verr.Message, validationStatus(verr))
+}
+
+func transactionCommand(userID uint64, sourceType string, txReq TransactionRequest) ApplyTransactionCommand {
+	return ApplyTransactionCommand{
 		UserID:        userID,
-		State:         txReq.State,
-		Amount:        amount,
 		SourceType:    sourceType,
-		CreatedAt:     timeNowUTC(),
+		State:         txReq.State,
+		Amount:        txReq.Amount,
+		TransactionID: txReq.TransactionID,
 	}
-	if err := s.store.CreateTransaction(tx); err != nil {
-		http.Error(w, "Failed to record transaction", http.StatusInternalServerError)
-		return
+}
+
+// transactionOutcome is the HTTP answer to a transaction, also carried by socket acks
+type transactionOutcome struct {
+	// Code is the HTTP status, Status is set on success and Error otherwise
+	Code   int
+	Status string
+	Error  string
+	// ErrorCode is the Code of a ValidationError
+	ErrorCode  string
+	RetryAfter string
+}
+
+// processTransaction applies cmd through the service
+func (s *APIServer) processTransaction(ctx context.Context, cmd ApplyTransactionCommand) transactionOutcome {
+	res, err := s.service.ApplyTransaction(ctx, cmd)
+	return outcomeOf(res.Replayed, err)
+}
+
+// outcomeOf maps the result of a BalanceService call to an HTTP answer
+func outcomeOf(replayed bool, err error) transactionOutcome {
+	var verr *ValidationError
+	var lerr *LimitError
+	switch {
+	case err == nil && replayed:
+		return transactionOutcome{Code: http.StatusOK, Status: "already processed"}
+	case err == nil:
+		return transactionOutcome{Code: http.StatusOK, Status: "success"}
+	case isTimeout(err):
+		return failed(http.StatusGatewayTimeout, "Request timed out")
+	case errors.As(err, &verr):
+		out := failed(validationStatus(verr), verr.Message)
+		out.ErrorCode = verr.Code
+		return out
+	case errors.As(err, &lerr):
+		out := failed(http.StatusTooManyRequests, lerr.Message)
+		out.ErrorCode = lerr.Code
+		out.RetryAfter = strconv.Itoa(retryAfterSeconds(lerr.RetryAfter))
+		return out
+	case errors.Is(err, errQueueFull):
+		out := failed(http.StatusTooManyRequests, "Too many transactions in progress for this user")
+		out.RetryAfter = "1"
+		return out
+	case errors.Is(err, ErrUserNotFound):
+		return failed(http.StatusNotFound, "User not found")
+	case errors.Is(err, ErrTransactionNotFound):
+		return failed(http.StatusNotFound, "Transaction not found")
+	case errors.Is(err, ErrConcurrentUpdate):
+		return failed(http.StatusConflict, "Concurrent balance update, retry the transaction")
+	case isTransientError(err):
+		return failed(http.StatusServiceUnavailable, "Database temporarily unavailable")
+	case errors.Is(err, ErrInsufficientFunds), errors.Is(err, ErrNotReversible):
+		return failed(http.StatusBadRequest, err.Error())
+	default:
+		// the errors of the store are logged by the service, not shown to clients
+		return failed(http.StatusInternalServerError, "Internal server error")
 	}
+}
 
-	// res with success
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": "success",
-	})
+// retryAfterSeconds rounds d up to the whole seconds of a Retry-After header
+func retryAfterSeconds(d time.Duration) int {
+	return max(1, int((d+time.Second-1)/time.Second))
+}
+
+func failed(code int, msg string) transactionOutcome {
+	return transactionOutcome{Code: code, Error: msg}
+}
+
+func writeOutcomeError(w http.ResponseWriter, out transactionOutcome) {
+	if out.ErrorCode != "" {
+		w.Header().Set(errorCodeHeader, out.ErrorCode)
+	}
+	if out.RetryAfter != "" {
+		w.Header().Set("Retry-After", out.RetryAfter)
+	}
+	http.Error(w, out.Error, out.Code)
 }
 
 func (s *APIServer) HandleGetBalance(w http.ResponseWriter, r *http.Request) {
@@ -135,50 +399,116 @@ func (s *APIServer) HandleGetBalance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	balance, err := s.store.GetUserBalance(userID)
-	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+	q := BalanceQuery{UserID: userID}
+	var ok bool
+	if q.StrongConsistency, ok = strongConsistencyParam(r); !ok {
+		http.Error(w, "Invalid consistency value", http.StatusBadRequest)
 		return
 	}
 
-	resp := BalanceResponse{
-		UserID:  userID,
-		Balance: formatAmount(balance),
+	ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+	defer cancel()
+
+	res, err := s.service.Balance(ctx, q)
+	if err != nil {
+		writeOutcomeError(w, outcomeOf(false, err))
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(resp)
+	json.NewEncoder(w).Encode(versionOf(r).payloads.balance(res))
 }
 
-func parseAmount(amountStr string) (float64, error) {
-	return strconv.ParseFloat(amountStr, 64)
+// strongConsistencyParam reads ?consistency=eventual|strong. Reads may be
+// served by a replica unless the client needs its own writes.
+func strongConsistencyParam(r *http.Request) (strong, ok bool) {
+	switch r.URL.Query().Get("consistency") {
+	case "", "eventual":
+		return false, true
+	case "strong":
+		return true, true
+	}
+	return false, false
 }
 
-func isValidAmount(amountStr string) bool {
-	if _, err := strconv.ParseFloat(amountStr, 64); err != nil {
-		return false
+// HandleListTransactions processes GET /user/{userId}/transactions
+func (s *APIServer) HandleListTransactions(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseUint(mux.Vars(r)["userId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid userId", http.StatusBadRequest)
+		return
 	}
-	parts := split(amountStr, '.')
-	if len(parts) == 2 && len(parts[1]) > 2 {
-		return false
+	q := HistoryQuery{UserID: userID}
+	query := r.URL.Query()
+	if v := query.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit == 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("beforeId"); v != "" {
+		if q.BeforeID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "Invalid beforeId", http.StatusBadRequest)
+			return
+		}
+	}
+	var ok bool
+	if q.StrongConsistency, ok = strongConsistencyParam(r); !ok {
+		http.Error(w, "Invalid consistency value", http.StatusBadRequest)
+		return
 	}
-	return true
-}
 
-func split(s string, sep rune) []string {
-	var parts []string
-	current := ""
-	for _, c := range s {
-		if c == sep {
-			parts = append(parts, current)
-			current = ""
-		} else {
-			current += string(c)
+	ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+	defer cancel()
+
+	page, err := s.service.History(ctx, q)
+	if err != nil {
+		out := outcomeOf(false, err)
+		if out.Code == http.StatusInternalServerError {
+			s.logger.ErrorContext(ctx, "failed to list transactions", "error", err)
 		}
+		writeOutcomeError(w, out)
+		return
 	}
-	parts = append(parts, current)
-	return parts
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versionOf(r).payloads.history(page))
+}
+
+func isValidationError(err error) bool {
+	var verr *ValidationError
+	return errors.As(err, &verr)
+}
+
+// HandleReverseTransaction processes POST /transactions/{transactionId}/reverse
+func (s *APIServer) HandleReverseTransaction(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+	defer cancel()
+
+	res, err := s.service.Reverse(ctx, ReverseCommand{
+		TransactionID: mux.Vars(r)["transactionId"],
+		SourceType:    r.Header.Get("Source-Type"),
+	})
+	out := outcomeOf(res.Replayed, err)
+	if out.Error != "" {
+		writeOutcomeError(w, out)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(out.Code)
+	json.NewEncoder(w).Encode(versionOf(r).payloads.reversal(out.Status, res.Reversal))
+}
+
+// traceStore runs a storage call inside a child span of the request span
+func (s *APIServer) traceStore(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	return s.service.traceStore(ctx, op, fn)
+}
+
+// isTimeout reports whether err comes from the request deadline or a client disconnect
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
 }
 
 func formatAmount(amount float64) string {
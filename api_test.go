@@ -2,15 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type MockStore struct {
@@ -25,15 +31,16 @@ func NewMockStore() *MockStore {
 	}
 }
 
-func (m *MockStore) CreateTransaction(tx Transaction) error {
+func (m *MockStore) CreateTransaction(ctx context.Context, tx Transaction) error {
 	if _, exists := m.Transactions[tx.TransactionID]; exists {
 		return errors.New("duplicate transaction")
 	}
+	tx.ID = int64(len(m.Transactions) + 1)
 	m.Transactions[tx.TransactionID] = tx
 	return nil
 }
 
-func (m *MockStore) GetUserBalance(userID uint64) (float64, error) {
+func (m *MockStore) GetUserBalance(ctx context.Context, userID uint64) (float64, error) {
 	balance, exists := m.Users[userID]
 	if !exists {
 		return 0, errors.New("user not found")
@@ -41,32 +48,65 @@ func (m *MockStore) GetUserBalance(userID uint64) (float64, error) {
 	return balance, nil
 }
 
-func (m *MockStore) GetTransactionByID(transactionID string) (*Transaction, error) {
+func (m *MockStore) GetTransactionByID(ctx context.Context, transactionID string) (*Transaction, error) {
 	tx, exists := m.Transactions[transactionID]
 	if !exists {
-		return nil, errors.New("transaction not found")
+		return nil, sql.ErrNoRows
 	}
 	return &tx, nil
 }
 
-func (m *MockStore) UpdateUserBalance(userID uint64, delta float64) error {
+func (m *MockStore) UpdateUserBalance(ctx context.Context, userID uint64, delta float64) error {
 	current, exists := m.Users[userID]
 	if !exists {
-		return errors.New("user not found")
+		// like the real stores, which find no row to update
+		return sql.ErrNoRows
 	}
 	newBalance := current + delta
 	if newBalance < 0 {
-		return errors.New("balance cannot be negative")
+		return ErrInsufficientFunds
 	}
 	m.Users[userID] = newBalance
 	return nil
 }
 
-func (m *MockStore) EnsurePredefinedUsers() error {
+func (m *MockStore) ApplyTransaction(ctx context.Context, tx Transaction, delta float64) error {
+	if _, exists := m.Transactions[tx.TransactionID]; exists {
+		return ErrDuplicateTransaction
+	}
+	if err := m.UpdateUserBalance(ctx, tx.UserID, delta); err != nil {
+		return err
+	}
+	return m.CreateTransaction(ctx, tx)
+}
+
+func (m *MockStore) ListTransactions(ctx context.Context, userID uint64, beforeID int64, limit int) ([]Transaction, error) {
+	txs := []Transaction{}
+	for _, tx := range m.Transactions {
+		if tx.UserID == userID && (beforeID == 0 || tx.ID < beforeID) {
+			txs = append(txs, tx)
+		}
+	}
+	sort.Slice(txs, func(i, j int) bool { return txs[i].ID > txs[j].ID })
+	if len(txs) > limit {
+		txs = txs[:limit]
+	}
+	return txs, nil
+}
+
+func (m *MockStore) ConsumeQuota(ctx context.Context, sourceType string, day time.Time, amount float64, quota QuotaConfig) error {
 	return nil
 }
 
-func (m *MockStore) Init() error {
+func (m *MockStore) ReleaseQuota(ctx context.Context, sourceType string, day time.Time, amount float64) error {
+	return nil
+}
+
+func (m *MockStore) EnsurePredefinedUsers(ctx context.Context) error {
+	return nil
+}
+
+func (m *MockStore) Init(ctx context.Context) error {
 	return nil
 }
 
@@ -103,7 +143,7 @@ func TestHandleTransaction_SuccessWin(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "success", resp["status"])
 
-	balance, err := store.GetUserBalance(1)
+	balance, err := store.GetUserBalance(context.Background(), 1)
 	assert.NoError(t, err)
 	assert.Equal(t, 10.15, balance)
 }
@@ -139,7 +179,7 @@ func TestHandleTransaction_SuccessLose(t *testing.T) {
 	assert.Equal(t, "success", resp["status"])
 
 	// verify balance
-	balance, err := store.GetUserBalance(1)
+	balance, err := store.GetUserBalance(context.Background(), 1)
 	assert.NoError(t, err)
 	assert.Equal(t, 5.0, balance)
 }
@@ -185,7 +225,7 @@ func TestHandleTransaction_Duplicate(t *testing.T) {
 	assert.Equal(t, "already processed", resp["status"])
 
 	// verify the balance didn't update it
-	balance, err := store.GetUserBalance(1)
+	balance, err := store.GetUserBalance(context.Background(), 1)
 	assert.NoError(t, err)
 	assert.Equal(t, 10.15, balance)
 }
@@ -282,3 +322,347 @@ func TestHandleGetBalance_UserNotFound(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, rr.Code)
 	assert.Contains(t, rr.Body.String(), "User not found")
 }
+
+// blockingStore waits for the request deadline on every balance read
+type blockingStore struct {
+	*MockStore
+}
+
+func (b blockingStore) GetUserBalance(ctx context.Context, userID uint64) (float64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestHandleGetBalance_Timeout(t *testing.T) {
+	server := NewAPIServer(blockingStore{NewMockStore()}, WithRequestTimeout(10*time.Millisecond))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/user/{userId}/balance", server.HandleGetBalance).Methods("GET")
+
+	req, err := http.NewRequest("GET", "/user/1/balance", nil)
+	assert.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Request timed out")
+}
+
+// racingStore loses the idempotency race: the pre-check misses the transaction
+// but ApplyTransaction finds it was recorded concurrently
+type racingStore struct {
+	*MockStore
+}
+
+func (r racingStore) ApplyTransaction(ctx context.Context, tx Transaction, delta float64) error {
+	return ErrDuplicateTransaction
+}
+
+func TestHandleTransaction_ConcurrentDuplicate(t *testing.T) {
+	server := NewAPIServer(racingStore{NewMockStore()})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/user/{userId}/transaction", server.HandleTransaction).Methods("POST")
+
+	body, _ := json.Marshal(TransactionRequest{State: "win", Amount: "1.00", TransactionID: "txn-race"})
+	req, err := http.NewRequest("POST", "/user/1/transaction", bytes.NewBuffer(body))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Source-Type", "game")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "already processed")
+}
+
+// consistencyStore records whether balance reads asked for strong consistency
+type consistencyStore struct {
+	*MockStore
+	strong *bool
+}
+
+func (c consistencyStore) GetUserBalance(ctx context.Context, userID uint64) (float64, error) {
+	*c.strong = strongConsistency(ctx)
+	return c.MockStore.GetUserBalance(ctx, userID)
+}
+
+func TestHandleGetBalance_Consistency(t *testing.T) {
+	var strong bool
+	server := NewAPIServer(consistencyStore{NewMockStore(), &strong})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/user/{userId}/balance", server.HandleGetBalance).Methods("GET")
+
+	tests := []struct {
+		query      string
+		wantCode   int
+		wantStrong bool
+	}{
+		{"", http.StatusOK, false},
+		{"?consistency=eventual", http.StatusOK, false},
+		{"?consistency=strong", http.StatusOK, true},
+		{"?consistency=bogus", http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		strong = false
+		req, err := http.NewRequest("GET", "/user/1/balance"+tt.query, nil)
+		assert.NoError(t, err)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, tt.wantCode, rr.Code, tt.query)
+		assert.Equal(t, tt.wantStrong, strong, tt.query)
+	}
+}
+
+// contendedStore always loses the optimistic update race
+type contendedStore struct {
+	*MockStore
+}
+
+func (c contendedStore) ApplyTransaction(ctx context.Context, tx Transaction, delta float64) error {
+	return ErrConcurrentUpdate
+}
+
+func TestHandleTransaction_ConcurrentUpdate(t *testing.T) {
+	server := NewAPIServer(contendedStore{NewMockStore()})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/user/{userId}/transaction", server.HandleTransaction).Methods("POST")
+
+	body, _ := json.Marshal(TransactionRequest{State: "win", Amount: "1.00", TransactionID: "txn-hot"})
+	req, err := http.NewRequest("POST", "/user/1/transaction", bytes.NewBuffer(body))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Source-Type", "game")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestHandleListTransactions(t *testing.T) {
+	store := NewMockStore()
+	store.Users[1] = 0
+	server := NewAPIServer(store)
+	router := server.Router()
+	for i := 1; i <= 3; i++ {
+		_, err := server.Service().ApplyTransaction(context.Background(), ApplyTransactionCommand{
+			UserID: 1, SourceType: "game", State: "win", Amount: "1.50", TransactionID: fmt.Sprint("hist-", i),
+		})
+		require.NoError(t, err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/user/1/transactions?limit=2", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var page TransactionHistoryResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &page))
+	require.Len(t, page.Transactions, 2)
+	assert.Equal(t, "hist-3", page.Transactions[0].TransactionID)
+	assert.Equal(t, "1.50", page.Transactions[0].Amount)
+	assert.Equal(t, page.Transactions[1].ID, page.NextBeforeID)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", fmt.Sprintf("/user/1/transactions?limit=2&beforeId=%d", page.NextBeforeID), nil))
+	page = TransactionHistoryResponse{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &page))
+	require.Len(t, page.Transactions, 1)
+	assert.Equal(t, "hist-1", page.Transactions[0].TransactionID)
+	assert.Zero(t, page.NextBeforeID)
+
+	for url, code := range map[string]int{
+		"/user/1/transactions?limit=501":          http.StatusBadRequest,
+		"/user/1/transactions?limit=x":            http.StatusBadRequest,
+		"/user/1/transactions?beforeId=-1":        http.StatusBadRequest,
+		"/user/1/transactions?consistency=x":      http.StatusBadRequest,
+		"/user/1/transactions?consistency=strong": http.StatusOK,
+		"/user/999/transactions":                  http.StatusNotFound,
+	} {
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+		assert.Equal(t, code, rr.Code, url)
+	}
+}
+
+func TestHandleReverseTransaction(t *testing.T) {
+	store := NewMockStore()
+	store.Users[1] = 0
+	server := NewAPIServer(store)
+	router := server.Router()
+	_, err := server.Service().ApplyTransaction(context.Background(), ApplyTransactionCommand{
+		UserID: 1, SourceType: "game", State: "win", Amount: "10.00", TransactionID: "rev-1",
+	})
+	require.NoError(t, err)
+
+	reverse := func(id, sourceType string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/transactions/"+id+"/reverse", nil)
+		if sourceType != "" {
+			req.Header.Set("Source-Type", sourceType)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := reverse("rev-1", "server")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var resp ReversalResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, "success", resp.Status)
+	assert.Equal(t, "reversal:rev-1", resp.Reversal.TransactionID)
+	assert.Equal(t, "lose", resp.Reversal.State)
+	assert.Equal(t, "10.00", resp.Reversal.Amount)
+	assert.Equal(t, 0.0, store.Users[1])
+
+	rr = reverse("rev-1", "server")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "already processed")
+
+	assert.Equal(t, http.StatusNotFound, reverse("missing", "server").Code)
+	assert.Equal(t, http.StatusBadRequest, reverse("reversal:rev-1", "server").Code)
+	assert.Equal(t, http.StatusBadRequest, reverse("rev-1", "").Code)
+}
+
+func TestHandleTransaction_ReservedID(t *testing.T) {
+	store := NewMockStore()
+	store.Users[1] = 0
+	router := NewAPIServer(store).Router()
+
+	body := `{"state":"win","amount":"1.00","transactionId":"reversal:abc"}`
+	req := httptest.NewRequest("POST", "/user/1/transaction", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Source-Type", "game")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "reserved")
+}
+
+func TestHandleTransaction_StrictBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		sourceType  string
+		body        string
+		status      int
+		code        string
+	}{
+		{"json with charset", "application/json; charset=utf-8", "game", `{"state":"win","amount":"1.00","transactionId":"strict-1"}`, http.StatusOK, ""},
+		{"missing content type", "", "game", `{"state":"win","amount":"1.00","transactionId":"strict-2"}`, http.StatusUnsupportedMediaType, "unsupported_media_type"},
+		{"form content type", "application/x-www-form-urlencoded", "game", `state=win`, http.StatusUnsupportedMediaType, "unsupported_media_type"},
+		{"unknown field", "application/json", "game", `{"state":"win","amount":"1.00","transactionId":"strict-3","extra":1}`, http.StatusBadRequest, "unknown_field"},
+		{"wrong type", "application/json", "game", `{"state":"win","amount":1,"transactionId":"strict-4"}`, http.StatusBadRequest, "invalid_type"},
+		{"trailing data", "application/json", "game", `{"state":"win","amount":"1.00","transactionId":"strict-5"} {}`, http.StatusBadRequest, "invalid_json"},
+		{"too large", "application/json", "game", `{"state":"win","amount":"1.00","transactionId":"` + strings.Repeat("x", maxBodySize) + `"}`, http.StatusRequestEntityTooLarge, "body_too_large"},
+		{"missing transactionId", "application/json", "game", `{"state":"win","amount":"1.00"}`, http.StatusBadRequest, "missing_transaction_id"},
+		{"empty transactionId", "application/json", "game", `{"state":"win","amount":"1.00","transactionId":""}`, http.StatusBadRequest, "missing_transaction_id"},
+		{"missing state", "application/json", "game", `{"amount":"1.00","transactionId":"strict-6"}`, http.StatusBadRequest, "invalid_state"},
+		{"unknown state", "application/json", "game", `{"state":"draw","amount":"1.00","transactionId":"strict-6"}`, http.StatusBadRequest, "invalid_state"},
+		{"missing amount", "application/json", "game", `{"state":"win","transactionId":"strict-6"}`, http.StatusBadRequest, "invalid_amount"},
+		{"zero amount", "application/json", "game", `{"state":"win","amount":"0","transactionId":"strict-6"}`, http.StatusBadRequest, "amount_not_positive"},
+		{"negative amount", "application/json", "game", `{"state":"win","amount":"-5","transactionId":"strict-7"}`, http.StatusBadRequest, "invalid_amount"},
+		{"over the maximum", "application/json", "game", `{"state":"win","amount":"100.01","transactionId":"strict-8"}`, http.StatusBadRequest, "amount_too_large"},
+		{"long source type", "application/json", strings.Repeat("g", maxSourceTypeLength+1), `{"state":"win","amount":"1.00","transactionId":"strict-9"}`, http.StatusBadRequest, "invalid_source_type"},
+		{"source type charset", "application/json", "game server", `{"state":"win","amount":"1.00","transactionId":"strict-9"}`, http.StatusBadRequest, "invalid_source_type"},
+	}
+
+	// the handler's own decoding and the schema check of the router must agree
+	routers := map[string]func(*APIServer) http.Handler{
+		"router": func(s *APIServer) http.Handler { return s.Router() },
+		"handler": func(s *APIServer) http.Handler {
+			router := mux.NewRouter()
+			router.HandleFunc("/v1/user/{userId}/transaction", s.HandleTransaction).Methods("POST")
+			return router
+		},
+	}
+	for name, newRouter := range routers {
+		t.Run(name, func(t *testing.T) {
+			store := NewMockStore()
+			router := newRouter(NewAPIServer(store, WithMaxAmount(100)))
+			for _, tt := range tests {
+				req := httptest.NewRequest("POST", "/v1/user/1/transaction", strings.NewReader(tt.body))
+				req.Header.Set("Source-Type", tt.sourceType)
+				if tt.contentType != "" {
+					req.Header.Set("Content-Type", tt.contentType)
+				}
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+
+				assert.Equal(t, tt.status, rr.Code, "%s: %s", tt.name, rr.Body.String())
+				assert.Equal(t, tt.code, rr.Header().Get("Error-Code"), tt.name)
+			}
+			assert.Equal(t, 1.0, store.Users[1], "only the valid request was applied")
+		})
+	}
+}
+
+func TestHandleTransaction_RateLimited(t *testing.T) {
+	router := NewAPIServer(NewMockStore(), WithRateLimits(RateLimitConfig{UserRate: 0.5, UserBurst: 1})).Router()
+	send := func(userID, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/user/"+userID+"/transaction", strings.NewReader(`{"state":"win","amount":"1.00","transactionId":"`+id+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Source-Type", "game")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusOK, send("1", "rl-1").Code)
+	rr := send("1", "rl-2")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "user_rate_limited", rr.Header().Get("Error-Code"))
+	assert.Equal(t, "2", rr.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, send("2", "rl-3").Code, "other users keep their own budget")
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, rr.Body.String(), `balance_limited_total{source_type="game",limit="user_rate_limited"} 1`)
+}
+
+// brokenStore fails transactions with an error the client must not see
+type brokenStore struct {
+	*MemoryStore
+}
+
+func (brokenStore) ApplyTransaction(ctx context.Context, tx Transaction, delta float64) error {
+	return errors.New("pq: value too long for type character varying(50)")
+}
+
+func TestHandleTransaction_StoreErrorIsInternal(t *testing.T) {
+	store := brokenStore{NewMemoryStore()}
+	require.NoError(t, store.Init(context.Background()))
+	router := NewAPIServer(store).Router()
+
+	body, _ := json.Marshal(TransactionRequest{State: "win", Amount: "1.00", TransactionID: "txn-broken"})
+	req := httptest.NewRequest("POST", "/v1/user/1/transaction", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Source-Type", "game")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Equal(t, "Internal server error\n", rr.Body.String())
+}
+
+func TestHandleTransaction_UnknownUser(t *testing.T) {
+	store := NewMemoryStore()
+	require.NoError(t, store.Init(context.Background()))
+	router := NewAPIServer(store).Router()
+
+	body, _ := json.Marshal(TransactionRequest{State: "win", Amount: "1.00", TransactionID: "txn-nobody"})
+	req := httptest.NewRequest("POST", "/v1/user/999/transaction", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Source-Type", "game")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, "User not found\n", rr.Body.String())
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheGenerations is the number of invalidation counters users are spread over
+const cacheGenerations = 256
+
+// BalanceCache stores user balances for CachedStore. Implementations backed by
+// an external service should treat their own failures as misses.
+type BalanceCache interface {
+	Get(ctx context.Context, userID uint64) (float64, bool)
+	Set(ctx context.Context, userID uint64, balance float64)
+	Delete(ctx context.Context, userID uint64)
+}
+
+// CacheStats are the counters exported as metrics
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+// CachedStore wraps a Storage and serves GetUserBalance from a BalanceCache.
+// Every balance mutation invalidates the user's entry, and misses are filled
+// from the primary, so a read after a write made through this store always
+// sees that write.
+type CachedStore struct {
+	Storage
+	cache BalanceCache
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+
+	// fillMu and gens keep a read that started before an invalidation from
+	// putting its stale result back into the cache
+	fillMu sync.Mutex
+	gens   [cacheGenerations]uint64
+}
+
+func NewCachedStore(store Storage, cache BalanceCache) *CachedStore {
+	return &CachedStore{
+		Storage: store,
+		cache:   cache,
+	}
+}
+
+// Unwrap returns the wrapped store
+func (c *CachedStore) Unwrap() Storage {
+	return c.Storage
+}
+
+// GetUserBalance serves cached balances unless ctx asks for strong
+// consistency; such reads go to the store and refresh the entry. Misses keep
+// the consistency of the caller, so with a replica a filled entry may lag
+// like the replica does.
+func (c *CachedStore) GetUserBalance(ctx context.Context, userID uint64) (float64, error) {
+	if !strongConsistency(ctx) {
+		if balance, ok := c.cache.Get(ctx, userID); ok {
+			c.hits.Add(1)
+			return balance, nil
+		}
+	}
+	c.misses.Add(1)
+
+	gen := c.generation(userID)
+	balance, err := c.Storage.GetUserBalance(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	c.fillMu.Lock()
+	if c.gens[userID%cacheGenerations] == gen {
+		c.cache.Set(ctx, userID, balance)
+	}
+	c.fillMu.Unlock()
+	return balance, nil
+}
+
+// UpdateUserBalance invalidates the cached balance whatever the outcome, an
+// error such as a timeout doesn't prove the write didn't commit
+func (c *CachedStore) UpdateUserBalance(ctx context.Context, userID uint64, delta float64) error {
+	defer c.invalidate(ctx, userID)
+	return c.Storage.UpdateUserBalance(ctx, userID, delta)
+}
+
+func (c *CachedStore) ApplyTransaction(ctx context.Context, tx Transaction, delta float64) error {
+	defer c.invalidate(ctx, tx.UserID)
+	return c.Storage.ApplyTransaction(ctx, tx, delta)
+}
+
+func (c *CachedStore) CacheStats() CacheStats {
+	stats := CacheStats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Entries: -1,
+	}
+	if lru, ok := c.cache.(*LRUCache); ok {
+		stats.Entries = lru.Len()
+	}
+	return stats
+}
+
+func (c *CachedStore) generation(userID uint64) uint64 {
+	c.fillMu.Lock()
+	defer c.fillMu.Unlock()
+	return c.gens[userID%cacheGenerations]
+}
+
+func (c *CachedStore) invalidate(ctx context.Context, userID uint64) {
+	c.fillMu.Lock()
+	defer c.fillMu.Unlock()
+	c.gens[userID%cacheGenerations]++
+	// the request may have timed out, the entry must go regardless
+	c.cache.Delete(context.WithoutCancel(ctx), userID)
+}
+
+// LRUCache is an in-process BalanceCache holding at most capacity entries,
+// each for at most ttl when ttl is positive
+type LRUCache struct {
+	capacity int
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[uint64]*list.Element
+}
+
+type lruEntry struct {
+	userID    uint64
+	balance   float64
+	expiresAt time.Time
+}
+
+func NewLRUCache(capacity int, ttl time.Duration) *LRUCache {
+	return &LRUCache{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[uint64]*list.Element),
+	}
+}
+
+func (l *LRUCache) Get(ctx context.Context, userID uint64) (float64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, ok := l.entries[userID]
+	if !ok {
+		return 0, false
+	}
+	entry := el.Value.(*lruEntry)
+	if l.ttl > 0 && time.Now().After(entry.expiresAt) {
+		l.order.Remove(el)
+		delete(l.entries, userID)
+		return 0, false
+	}
+	l.order.MoveToFront(el)
+	return entry.balance, true
+}
+
+func (l *LRUCache) Set(ctx context.Context, userID uint64, balance float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	expiresAt := time.Now().Add(l.ttl)
+	if el, ok := l.entries[userID]; ok {
+		entry := el.Value.(*lruEntry)
+		entry.balance = balance
+		entry.expiresAt = expiresAt
+		l.order.MoveToFront(el)
+		return
+	}
+
+	l.entries[userID] = l.order.PushFront(&lruEntry{userID: userID, balance: balance, expiresAt: expiresAt})
+	for l.order.Len() > l.capacity {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*lruEntry).userID)
+	}
+}
+
+func (l *LRUCache) Delete(ctx context.Context, userID uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if el, ok := l.entries[userID]; ok {
+		l.order.Remove(el)
+		delete(l.entries, userID)
+	}
+}
+
+func (l *LRUCache) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRUCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	cache := NewLRUCache(2, 0)
+	cache.Set(ctx, 1, 10)
+	cache.Set(ctx, 2, 20)
+	cache.Get(ctx, 1)
+	cache.Set(ctx, 3, 30)
+
+	_, ok := cache.Get(ctx, 2)
+	assert.False(t, ok, "user 2 was least recently used")
+	balance, ok := cache.Get(ctx, 1)
+	assert.True(t, ok)
+	assert.Equal(t, 10.0, balance)
+	assert.Equal(t, 2, cache.Len())
+}
+
+func TestLRUCache_Expires(t *testing.T) {
+	ctx := context.Background()
+	cache := NewLRUCache(10, time.Millisecond)
+	cache.Set(ctx, 1, 10)
+	time.Sleep(5 * time.Millisecond)
+
+	_, ok := cache.Get(ctx, 1)
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestCachedStore_HitsAndInvalidation(t *testing.T) {
+	ctx := context.Background()
+	store := NewCachedStore(NewMemoryStore(), NewLRUCache(10, 0))
+	assert.NoError(t, store.Init(ctx))
+
+	balance, err := store.GetUserBalance(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, balance)
+	_, err = store.GetUserBalance(ctx, 1)
+	assert.NoError(t, err)
+
+	tx := Transaction{TransactionID: "txn-cache", UserID: 1, State: "win", Amount: 7.5, SourceType: "game", CreatedAt: timeNowUTC()}
+	assert.NoError(t, store.ApplyTransaction(ctx, tx, 7.5))
+
+	balance, err = store.GetUserBalance(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 7.5, balance, "a read after a write must see it")
+
+	assert.NoError(t, store.UpdateUserBalance(ctx, 1, -2.5))
+	balance, err = store.GetUserBalance(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 5.0, balance)
+
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 3, Entries: 1}, store.CacheStats())
+}
+
+func TestCachedStore_DoesNotCacheErrors(t *testing.T) {
+	ctx := context.Background()
+	store := NewCachedStore(NewMemoryStore(), NewLRUCache(10, 0))
+
+	_, err := store.GetUserBalance(ctx, 999)
+	assert.Error(t, err)
+	_, err = store.GetUserBalance(ctx, 999)
+	assert.Error(t, err)
+	assert.Equal(t, uint64(2), store.CacheStats().Misses)
+}
+
+// slowReadStore lets a test interleave a write with an in-flight balance read
+type slowReadStore struct {
+	*MemoryStore
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (s slowReadStore) GetUserBalance(ctx context.Context, userID uint64) (float64, error) {
+	balance, err := s.MemoryStore.GetUserBalance(ctx, userID)
+	s.read <- struct{}{}
+	<-s.release
+	return balance, err
+}
+
+func TestCachedStore_StaleReadIsNotCached(t *testing.T) {
+	ctx := context.Background()
+	inner := slowReadStore{NewMemoryStore(), make(chan struct{}), make(chan struct{})}
+	assert.NoError(t, inner.Init(ctx))
+	store := NewCachedStore(inner, NewLRUCache(10, 0))
+
+	done := make(chan float64)
+	go func() {
+		balance, _ := store.GetUserBalance(ctx, 1)
+		done <- balance
+	}()
+	<-inner.read
+
+	// the write lands while the old balance is on its way back
+	tx := Transaction{TransactionID: "txn-stale", UserID: 1, State: "win", Amount: 3, SourceType: "game", CreatedAt: timeNowUTC()}
+	assert.NoError(t, store.ApplyTransaction(ctx, tx, 3))
+	close(inner.release)
+	assert.Equal(t, 0.0, <-done)
+
+	go func() { <-inner.read }()
+	balance, err := store.GetUserBalance(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 3.0, balance)
+}
+
+func TestHandleMetrics_CacheStats(t *testing.T) {
+	store := NewCachedStore(NewMockStore(), NewLRUCache(10, 0))
+	router := NewAPIServer(store).Router()
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/user/1/balance", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/user/1/balance", nil))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, rr.Body.String(), "balance_cache_hits_total 1\n")
+	assert.Contains(t, rr.Body.String(), "balance_cache_misses_total 1\n")
+	assert.Contains(t, rr.Body.String(), "balance_cache_entries 1\n")
+}
+
+// consistencyRecorder remembers whether each balance read asked for strong consistency
+type consistencyRecorder struct {
+	*MemoryStore
+	strong []bool
+}
+
+func (s *consistencyRecorder) GetUserBalance(ctx context.Context, userID uint64) (float64, error) {
+	s.strong = append(s.strong, strongConsistency(ctx))
+	return s.MemoryStore.GetUserBalance(ctx, userID)
+}
+
+func TestCachedStore_StrongConsistencyBypassesCache(t *testing.T) {
+	ctx := context.Background()
+	inner := &consistencyRecorder{MemoryStore: NewMemoryStore()}
+	assert.NoError(t, inner.Init(ctx))
+	store := NewCachedStore(inner, NewLRUCache(10, 0))
+
+	_, err := store.GetUserBalance(ctx, 1)
+	assert.NoError(t, err)
+	// another instance writes, this cache isn't told
+	assert.NoError(t, inner.UpdateUserBalance(ctx, 1, 4))
+
+	balance, _ := store.GetUserBalance(ctx, 1)
+	assert.Equal(t, 0.0, balance, "eventual reads may be served from the cache")
+	balance, _ = store.GetUserBalance(WithStrongConsistency(ctx), 1)
+	assert.Equal(t, 4.0, balance, "strong reads go to the store")
+	balance, _ = store.GetUserBalance(ctx, 1)
+	assert.Equal(t, 4.0, balance, "and refresh the entry")
+
+	assert.Equal(t, []bool{false, true}, inner.strong, "misses keep the caller's consistency")
+}
@@ -1,18 +1,13 @@
 #!/bin/sh
 
-echo "Waiting PostgreSQL..."
-until pg_isready -h "$DB_HOST" -p "$DB_PORT" -U "$DB_USER"; do
-  echo "PostgreSQL is not ready..."
-  sleep 2
-done
-echo "PostgreSQL está listo."
-
+# The application waits for the database itself, see DB_CONNECT_RETRIES
 if [ "$SEED" = "true" ]; then
   echo "Seeding predefined users..."
-  ./go-balance-manager -addr=${APP_ADDR} -dbhost=${DB_HOST} -dbport=${DB_PORT} -dbuser=${DB_USER} -dbpass=${DB_PASS} -dbname=${DB_NAME} -seed=true
+  ./go-balance-manager -seed=true
   exit 0
 fi
 
-# Start the application
+# Start the application, configuration is read from the environment so the
+# database password never shows up in the process list
 echo "Starting Go Balance Manager..."
-./go-balance-manager -addr=${APP_ADDR} -dbhost=${DB_HOST} -dbport=${DB_PORT} -dbuser=${DB_USER} -dbpass=${DB_PASS} -dbname=${DB_NAME}
\ No newline at end of file
+exec ./go-balance-manager
\ No newline at end of file
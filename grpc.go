@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+
+	balancev1 "go-balance-manager/proto/balance/v1"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// GRPCServer builds the gRPC server of balance.v1.BalanceService. It shares
+// the BalanceService of the REST handlers, so both answer alike.
+func (s *APIServer) GRPCServer() *grpc.Server {
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(s.grpcTracing, s.grpcLogging))
+	balancev1.RegisterBalanceServiceServer(srv, &grpcBalanceServer{api: s})
+	reflection.Register(srv)
+	return srv
+}
+
+// RunGRPC serves the gRPC API on addr, next to the HTTP server
+func (s *APIServer) RunGRPC(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("grpc server running", "addr", addr)
+	return s.GRPCServer().Serve(lis)
+}
+
+// grpcTracing continues the caller's trace from the traceparent metadata and
+// wraps the call in a server span
+func (s *APIServer) grpcTracing(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	remote, _ := ParseTraceparent(firstMetadata(md, "traceparent"))
+
+	ctx, span := s.tracer.start(ctx, info.FullMethod, "server", remote)
+	defer span.End()
+	span.SetAttribute("rpc.system", "grpc")
+	span.SetAttribute("rpc.method", info.FullMethod)
+	grpc.SetHeader(ctx, metadata.Pairs(traceIDHeader, span.sc.TraceID.String()))
+
+	resp, err := handler(ctx, req)
+	code := status.Code(err)
+	span.SetAttribute("rpc.grpc.status_code", int(code))
+	if grpcServerFault(code) {
+		span.RecordError(err)
+	}
+	return resp, err
+}
+
+// grpcLogging assigns a request ID and writes one access log line per call,
+// like LoggingMiddleware does for HTTP requests
+func (s *APIServer) grpcLogging(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	requestID := firstMetadata(md, requestIDHeader)
+	if !validRequestID.MatchString(requestID) {
+		requestID = newRequestID()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDHeader, requestID))
+
+	rl := &requestLog{requestID: requestID}
+	ctx = context.WithValue(ctx, requestLogKey{}, rl)
+
+	resp, err := handler(ctx, req)
+	code := status.Code(err)
+
+	attrs := []slog.Attr{
+		slog.String("method", info.FullMethod),
+		slog.String("code", code.String()),
+		slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+	}
+	rl.mu.Lock()
+	hasOutcome := false
+	for _, a := range rl.attrs {
+		if a.Key == "outcome" {
+			hasOutcome = true
+		}
+	}
+	attrs = append(attrs, rl.attrs...)
+	rl.mu.Unlock()
+	if !hasOutcome {
+		outcome := "success"
+		switch {
+		case grpcServerFault(code):
+			outcome = "error"
+		case code != codes.OK:
+			outcome = "rejected"
+		}
+		attrs = append(attrs, slog.String("outcome", outcome))
+	}
+
+	level := slog.LevelInfo
+	if grpcServerFault(code) {
+		level = slog.LevelError
+	}
+	s.logger.LogAttrs(ctx, level, "rpc", attrs...)
+	return resp, err
+}
+
+// grpcServerFault reports the codes counted as errors, like 5xx statuses
+func grpcServerFault(code codes.Code) bool {
+	switch code {
+	case codes.Internal, codes.Unavailable, codes.DeadlineExceeded, codes.Unknown, codes.DataLoss:
+		return true
+	}
+	return false
+}
+
+func firstMetadata(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// grpcBalanceServer implements balancev1.BalanceServiceServer over the
+// BalanceService of an APIServer
+type grpcBalanceServer struct {
+	balancev1.UnimplementedBalanceServiceServer
+	api *APIServer
+}
+
+func (g *grpcBalanceServer) ApplyTransaction(ctx context.Context, req *balancev1.ApplyTransactionRequest) (*balancev1.ApplyTransactionResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, g.api.requestTimeout)
+	defer cancel()
+	annotateRequest(ctx, slog.Uint64("userId", req.UserId), slog.String("source_type", req.SourceType))
+
+	res, err := g.api.service.ApplyTransaction(ctx, ApplyTransactionCommand{
+		UserID:        req.UserId,
+		SourceType:    req.SourceType,
+		State:         req.State,
+		Amount:        req.Amount,
+		TransactionID: req.TransactionId,
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &balancev1.ApplyTransactionResponse{Status: outcomeOf(res.Replayed, nil).Status}, nil
+}
+
+func (g *grpcBalanceServer) GetBalance(ctx context.Context, req *balancev1.GetBalanceRequest) (*balancev1.GetBalanceResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, g.api.requestTimeout)
+	defer cancel()
+	annotateRequest(ctx, slog.Uint64("userId", req.UserId))
+
+	res, err := g.api.service.Balance(ctx, BalanceQuery{UserID: req.UserId, StrongConsistency: req.StrongConsistency})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &balancev1.GetBalanceResponse{UserId: res.UserID, Balance: formatAmount(res.Balance)}, nil
+}
+
+func (g *grpcBalanceServer) ListTransactions(ctx context.Context, req *balancev1.ListTransactionsRequest) (*balancev1.ListTransactionsResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, g.api.requestTimeout)
+	defer cancel()
+	annotateRequest(ctx, slog.Uint64("userId", req.UserId))
+
+	page, err := g.api.service.History(ctx, HistoryQuery{UserID: req.UserId, BeforeID: req.BeforeId, Limit: int(req.Limit), StrongConsistency: req.StrongConsistency})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &balancev1.ListTransactionsResponse{
+		Transactions: make([]*balancev1.Transaction, 0, len(page.Transactions)),
+		NextBeforeId: page.NextBeforeID,
+	}
+	for _, tx := range page.Transactions {
+		resp.Transactions = append(resp.Transactions, transactionProto(tx))
+	}
+	return resp, nil
+}
+
+func (g *grpcBalanceServer) ReverseTransaction(ctx context.Context, req *balancev1.ReverseTransactionRequest) (*balancev1.ReverseTransactionResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, g.api.requestTimeout)
+	defer cancel()
+	annotateRequest(ctx, slog.String("source_type", req.SourceType))
+
+	res, err := g.api.service.Reverse(ctx, ReverseCommand{TransactionID: req.TransactionId, SourceType: req.SourceType})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &balancev1.ReverseTransactionResponse{
+		Status:   outcomeOf(res.Replayed, nil).Status,
+		Reversal: transactionProto(res.Reversal),
+	}, nil
+}
+
+func transactionProto(tx Transaction) *balancev1.Transaction {
+	return &balancev1.Transaction{
+		Id:            tx.ID,
+		TransactionId: tx.TransactionID,
+		UserId:        tx.UserID,
+		State:         tx.State,
+		Amount:        formatAmount(tx.Amount),
+		SourceType:    tx.SourceType,
+		CreatedAt:     timestamppb.New(tx.CreatedAt),
+	}
+}
+
+// grpcError maps a BalanceService error to a status carrying the message the
+// REST API would answer with
+func grpcError(err error) error {
+	msg := outcomeOf(false, err).Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, msg)
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, msg)
+	case isValidationError(err):
+		return validationStatusError(err)
+	case errors.Is(err, ErrUserNotFound), errors.Is(err, ErrTransactionNotFound):
+		return status.Error(codes.NotFound, msg)
+	case errors.Is(err, ErrInsufficientFunds), errors.Is(err, ErrNotReversible):
+		return status.Error(codes.FailedPrecondition, msg)
+	case errors.Is(err, ErrConcurrentUpdate):
+		return status.Error(codes.Aborted, msg)
+	case errors.As(err, new(*LimitError)):
+		return limitStatusError(err)
+	case errors.Is(err, errQueueFull):
+		return status.Error(codes.ResourceExhausted, msg)
+	case isTransientError(err):
+		return status.Error(codes.Unavailable, msg)
+	default:
+		return status.Error(codes.Internal, msg)
+	}
+}
+
+// validationStatusError carries the code and field of a ValidationError in an
+// ErrorInfo detail, like the Error-Code header of the REST API
+func validationStatusError(err error) error {
+	var verr *ValidationError
+	errors.As(err, &verr)
+	st, detailErr := status.New(codes.InvalidArgument, verr.Message).WithDetails(&errdetails.ErrorInfo{
+		Reason:   verr.Code,
+		Domain:   "balance.v1",
+		Metadata: map[string]string{"field": verr.Field},
+	})
+	if detailErr != nil {
+		return status.Error(codes.InvalidArgument, verr.Message)
+	}
+	return st.Err()
+}
+
+// limitStatusError carries the limit of a LimitError in an ErrorInfo detail
+// and its delay in a RetryInfo, like the Retry-After header of the REST API
+func limitStatusError(err error) error {
+	var lerr *LimitError
+	errors.As(err, &lerr)
+	st, detailErr := status.New(codes.ResourceExhausted, lerr.Message).WithDetails(
+		&errdetails.ErrorInfo{Reason: lerr.Code, Domain: "balance.v1"},
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(lerr.RetryAfter)},
+	)
+	if detailErr != nil {
+		return status.Error(codes.ResourceExhausted, lerr.Message)
+	}
+	return st.Err()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	balancev1 "go-balance-manager/proto/balance/v1"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newGRPCClient(t *testing.T, store Storage, opts ...ServerOption) balancev1.BalanceServiceClient {
+	lis := bufconn.Listen(1 << 20)
+	srv := NewAPIServer(store, opts...).GRPCServer()
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return balancev1.NewBalanceServiceClient(conn)
+}
+
+func TestGRPC_ApplyTransactionAndGetBalance(t *testing.T) {
+	ctx := context.Background()
+	client := newGRPCClient(t, NewMockStore())
+
+	req := &balancev1.ApplyTransactionRequest{UserId: 1, SourceType: "game", State: "win", Amount: "10.25", TransactionId: "g-1"}
+	var header metadata.MD
+	resp, err := client.ApplyTransaction(ctx, req, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.Equal(t, "success", resp.Status)
+	assert.NotEmpty(t, header.Get(requestIDHeader))
+	assert.NotEmpty(t, header.Get(traceIDHeader))
+
+	resp, err = client.ApplyTransaction(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "already processed", resp.Status)
+
+	balance, err := client.GetBalance(ctx, &balancev1.GetBalanceRequest{UserId: 1, StrongConsistency: true})
+	require.NoError(t, err)
+	assert.Equal(t, "10.25", balance.Balance)
+}
+
+func TestGRPC_ErrorCodes(t *testing.T) {
+	ctx := context.Background()
+	client := newGRPCClient(t, NewMockStore())
+
+	tests := []struct {
+		name string
+		call func() error
+		code codes.Code
+		msg  string
+	}{
+		{"invalid state", func() error {
+			_, err := client.ApplyTransaction(ctx, &balancev1.ApplyTransactionRequest{UserId: 1, SourceType: "game", State: "draw", Amount: "1", TransactionId: "e-1"})
+			return err
+		}, codes.InvalidArgument, "Invalid state value"},
+		{"missing source type", func() error {
+			_, err := client.ApplyTransaction(ctx, &balancev1.ApplyTransactionRequest{UserId: 1, State: "win", Amount: "1", TransactionId: "e-2"})
+			return err
+		}, codes.InvalidArgument, "Missing Source-Type header"},
+		{"insufficient funds", func() error {
+			_, err := client.ApplyTransaction(ctx, &balancev1.ApplyTransactionRequest{UserId: 1, SourceType: "game", State: "lose", Amount: "1", TransactionId: "e-3"})
+			return err
+		}, codes.FailedPrecondition, ErrInsufficientFunds.Error()},
+		{"unknown user", func() error {
+			_, err := client.GetBalance(ctx, &balancev1.GetBalanceRequest{UserId: 999})
+			return err
+		}, codes.NotFound, "User not found"},
+		{"transaction of an unknown user", func() error {
+			_, err := client.ApplyTransaction(ctx, &balancev1.ApplyTransactionRequest{UserId: 999, SourceType: "game", State: "win", Amount: "1", TransactionId: "e-4"})
+			return err
+		}, codes.NotFound, "User not found"},
+		{"invalid limit", func() error {
+			_, err := client.ListTransactions(ctx, &balancev1.ListTransactionsRequest{UserId: 1, Limit: 1000})
+			return err
+		}, codes.InvalidArgument, "Invalid limit"},
+		{"unknown transaction", func() error {
+			_, err := client.ReverseTransaction(ctx, &balancev1.ReverseTransactionRequest{TransactionId: "missing", SourceType: "server"})
+			return err
+		}, codes.NotFound, "Transaction not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, _ := status.FromError(tt.call())
+			assert.Equal(t, tt.code, st.Code())
+			assert.Equal(t, tt.msg, st.Message())
+		})
+	}
+}
+
+func TestGRPC_HistoryAndReversal(t *testing.T) {
+	ctx := context.Background()
+	client := newGRPCClient(t, NewMockStore())
+
+	for _, id := range []string{"h-1", "h-2"} {
+		_, err := client.ApplyTransaction(ctx, &balancev1.ApplyTransactionRequest{UserId: 2, SourceType: "game", State: "win", Amount: "3.00", TransactionId: id})
+		require.NoError(t, err)
+	}
+	rev, err := client.ReverseTransaction(ctx, &balancev1.ReverseTransactionRequest{TransactionId: "h-1", SourceType: "server"})
+	require.NoError(t, err)
+	assert.Equal(t, "success", rev.Status)
+	assert.Equal(t, "reversal:h-1", rev.Reversal.TransactionId)
+	assert.Equal(t, "lose", rev.Reversal.State)
+
+	_, err = client.ReverseTransaction(ctx, &balancev1.ReverseTransactionRequest{TransactionId: "reversal:h-1", SourceType: "server"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	page, err := client.ListTransactions(ctx, &balancev1.ListTransactionsRequest{UserId: 2, Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, page.Transactions, 2)
+	assert.Equal(t, "reversal:h-1", page.Transactions[0].TransactionId)
+	assert.Equal(t, "h-2", page.Transactions[1].TransactionId)
+	assert.Equal(t, page.Transactions[1].Id, page.NextBeforeId)
+
+	page, err = client.ListTransactions(ctx, &balancev1.ListTransactionsRequest{UserId: 2, Limit: 2, BeforeId: page.NextBeforeId})
+	require.NoError(t, err)
+	require.Len(t, page.Transactions, 1)
+	assert.Equal(t, "h-1", page.Transactions[0].TransactionId)
+	assert.Zero(t, page.NextBeforeId)
+
+	balance, err := client.GetBalance(ctx, &balancev1.GetBalanceRequest{UserId: 2})
+	require.NoError(t, err)
+	assert.Equal(t, "3.00", balance.Balance)
+}
+
+func TestGRPC_ValidationErrorInfo(t *testing.T) {
+	client := newGRPCClient(t, NewMockStore())
+
+	_, err := client.ApplyTransaction(context.Background(), &balancev1.ApplyTransactionRequest{UserId: 1, SourceType: "game", State: "win", Amount: "1e3", TransactionId: "info-1"})
+	st := status.Convert(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	require.Len(t, st.Details(), 1)
+	info, ok := st.Details()[0].(*errdetails.ErrorInfo)
+	require.True(t, ok)
+	assert.Equal(t, "invalid_amount", info.Reason)
+	assert.Equal(t, "amount", info.Metadata["field"])
+}
+
+func TestGRPC_RateLimitRetryInfo(t *testing.T) {
+	client := newGRPCClient(t, NewMockStore(), WithRateLimits(RateLimitConfig{SourceRate: 1, SourceBurst: 1}))
+
+	req := &balancev1.ApplyTransactionRequest{UserId: 1, SourceType: "game", State: "win", Amount: "1", TransactionId: "grpc-rl-1"}
+	_, err := client.ApplyTransaction(context.Background(), req)
+	require.NoError(t, err)
+	req.TransactionId = "grpc-rl-2"
+	_, err = client.ApplyTransaction(context.Background(), req)
+
+	st := status.Convert(err)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	require.Len(t, st.Details(), 2)
+	assert.Equal(t, "source_rate_limited", st.Details()[0].(*errdetails.ErrorInfo).Reason)
+	assert.Positive(t, st.Details()[1].(*errdetails.RetryInfo).RetryDelay.AsDuration())
+}
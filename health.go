@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// readinessTimeout bounds the dependency checks done by /readyz
+const readinessTimeout = 2 * time.Second
+
+// HealthChecker is implemented by stores backed by a database connection pool
+type HealthChecker interface {
+	Ping(ctx context.Context) error
+	SchemaVersion(ctx context.Context) (int, error)
+	Stats() sql.DBStats
+}
+
+// healthChecker finds the HealthChecker behind store, looking through
+// wrappers such as CachedStore
+func healthChecker(store Storage) (HealthChecker, bool) {
+	for {
+		if hc, ok := store.(HealthChecker); ok {
+			return hc, true
+		}
+		w, ok := store.(interface{ Unwrap() Storage })
+		if !ok {
+			return nil, false
+		}
+		store = w.Unwrap()
+	}
+}
+
+type ReadinessResponse struct {
+	Status        string            `json:"status"`
+	Checks        map[string]string `json:"checks"`
+	SchemaVersion int               `json:"schemaVersion,omitempty"`
+	Pool          *PoolStats        `json:"pool,omitempty"`
+}
+
+type PoolStats struct {
+	MaxOpenConnections int   `json:"maxOpenConnections"`
+	OpenConnections    int   `json:"openConnections"`
+	InUse              int   `json:"inUse"`
+	Idle               int   `json:"idle"`
+	WaitCount          int64 `json:"waitCount"`
+	WaitDurationMs     int64 `json:"waitDurationMs"`
+	MaxIdleClosed      int64 `json:"maxIdleClosed"`
+	MaxLifetimeClosed  int64 `json:"maxLifetimeClosed"`
+}
+
+// HandleLivez reports whether the process is up, without touching dependencies
+func (s *APIServer) HandleLivez(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// HandleReadyz reports whether the service is able to serve transactions
+func (s *APIServer) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	resp := ReadinessResponse{
+		Status: "ok",
+		Checks: map[string]string{},
+	}
+
+	if hc, ok := healthChecker(s.store); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		if err := hc.Ping(ctx); err != nil {
+			resp.Status = "unavailable"
+			resp.Checks["database"] = err.Error()
+		} else {
+			resp.Checks["database"] = "ok"
+
+			version, err := hc.SchemaVersion(ctx)
+			switch {
+			case err != nil:
+				resp.Status = "unavailable"
+				resp.Checks["schema"] = err.Error()
+			case version < expectedSchemaVersion:
+				resp.Status = "unavailable"
+				resp.Checks["schema"] = "pending migrations"
+			default:
+				resp.Checks["schema"] = "ok"
+			}
+			resp.SchemaVersion = version
+		}
+
+		stats := newPoolStats(hc.Stats())
+		resp.Pool = &stats
+	}
+
+	status := http.StatusOK
+	if resp.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func newPoolStats(stats sql.DBStats) PoolStats {
+	return PoolStats{
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDurationMs:     stats.WaitDuration.Milliseconds(),
+		MaxIdleClosed:      stats.MaxIdleClosed,
+		MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+	}
+}
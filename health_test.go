@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleLivez(t *testing.T) {
+	server := NewAPIServer(NewMockStore())
+
+	req := httptest.NewRequest("GET", "/livez", nil)
+	rr := httptest.NewRecorder()
+	server.HandleLivez(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "OK", rr.Body.String())
+}
+
+func TestHandleReadyz_Ready(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	server := NewAPIServer(&PostgresStore{Db: db})
+
+	mock.ExpectPing()
+	mock.ExpectQuery("SELECT CASE WHEN to_regclass").
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(expectedSchemaVersion))
+
+	req := httptest.NewRequest("GET", "/readyz", nil)
+	rr := httptest.NewRecorder()
+	server.HandleReadyz(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var resp ReadinessResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, "ok", resp.Status)
+	assert.Equal(t, "ok", resp.Checks["database"])
+	assert.Equal(t, "ok", resp.Checks["schema"])
+	assert.Equal(t, expectedSchemaVersion, resp.SchemaVersion)
+	assert.NotNil(t, resp.Pool)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestHandleReadyz_DatabaseDown(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	server := NewAPIServer(&PostgresStore{Db: db})
+
+	mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+
+	req := httptest.NewRequest("GET", "/readyz", nil)
+	rr := httptest.NewRecorder()
+	server.HandleReadyz(rr, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	var resp ReadinessResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, "unavailable", resp.Status)
+	assert.Equal(t, "connection refused", resp.Checks["database"])
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestHandleReadyz_PendingMigrations(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	server := NewAPIServer(&PostgresStore{Db: db})
+
+	mock.ExpectPing()
+	mock.ExpectQuery("SELECT CASE WHEN to_regclass").
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(expectedSchemaVersion - 1))
+
+	req := httptest.NewRequest("GET", "/readyz", nil)
+	rr := httptest.NewRecorder()
+	server.HandleReadyz(rr, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Contains(t, rr.Body.String(), "pending migrations")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestHandleReadyz_ThroughCache(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	server := NewAPIServer(NewCachedStore(&PostgresStore{Db: db}, NewLRUCache(10, 0)))
+
+	mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+
+	req := httptest.NewRequest("GET", "/readyz", nil)
+	rr := httptest.NewRecorder()
+	server.HandleReadyz(rr, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// requestIDHeader is accepted from callers and always echoed on responses
+const requestIDHeader = "X-Request-Id"
+
+const redacted = "REDACTED"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// NewLogger builds a structured logger, format is json or text and level one
+// of debug, info, warn or error
+func NewLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{
+		Level:       lvl,
+		ReplaceAttr: redactAttr,
+	}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+	return slog.New(contextHandler{handler}), nil
+}
+
+var sensitiveKeys = map[string]bool{
+	"password":      true,
+	"dbpass":        true,
+	"secret":        true,
+	"token":         true,
+	"authorization": true,
+}
+
+// redactAttr hides secret attributes and passwords embedded in DSNs
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+	if a.Value.Kind() == slog.KindString {
+		if v := a.Value.String(); strings.Contains(v, "password") || strings.Contains(v, "://") {
+			return slog.String(a.Key, redactDSN(v))
+		}
+	}
+	return a
+}
+
+var (
+	dsnKeywordPassword = regexp.MustCompile(`(password=)('(?:[^'\\]|\\.)*'|\S+)`)
+	dsnURLPassword     = regexp.MustCompile(`(://[^:/@\s]+:)([^@\s]+)(@)`)
+)
+
+// redactDSN masks the password in keyword/value and URL style connection strings
+func redactDSN(dsn string) string {
+	dsn = dsnKeywordPassword.ReplaceAllString(dsn, "${1}"+redacted)
+	return dsnURLPassword.ReplaceAllString(dsn, "${1}"+redacted+"${3}")
+}
+
+// contextHandler adds the request and trace IDs found in the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if rl := requestLogFromContext(ctx); rl != nil {
+		r.AddAttrs(slog.String("request_id", rl.requestID))
+	}
+	if span := SpanFromContext(ctx); span != nil {
+		r.AddAttrs(slog.String("trace_id", span.SpanContext().TraceID.String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// requestLog collects the attributes handlers want in the access log line
+type requestLog struct {
+	requestID string
+
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+type requestLogKey struct{}
+
+func requestLogFromContext(ctx context.Context) *requestLog {
+	rl, _ := ctx.Value(requestLogKey{}).(*requestLog)
+	return rl
+}
+
+// annotateRequest adds attributes to the access log line of the current request
+func annotateRequest(ctx context.Context, attrs ...slog.Attr) {
+	rl := requestLogFromContext(ctx)
+	if rl == nil {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.attrs = append(rl.attrs, attrs...)
+}
+
+// setOutcome records how the request ended, e.g. success or insufficient_funds
+func setOutcome(ctx context.Context, outcome string) {
+	annotateRequest(ctx, slog.String("outcome", outcome))
+}
+
+// LoggingMiddleware assigns a request ID and writes one access log line per request
+func LoggingMiddleware(logger *slog.Logger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			requestID := r.Header.Get(requestIDHeader)
+			if !validRequestID.MatchString(requestID) {
+				requestID = newRequestID()
+			}
+			w.Header().Set(requestIDHeader, requestID)
+
+			rl := &requestLog{requestID: requestID}
+			ctx := context.WithValue(r.Context(), requestLogKey{}, rl)
+
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r.WithContext(ctx))
+
+			route := r.URL.Path
+			if cr := mux.CurrentRoute(r); cr != nil {
+				if tpl, err := cr.GetPathTemplate(); err == nil {
+					route = tpl
+				}
+			}
+
+			attrs := []slog.Attr{
+				slog.String("method", r.Method),
+				slog.String("route", route),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", rec.status),
+				slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			}
+			if userID := mux.Vars(r)["userId"]; userID != "" {
+				attrs = append(attrs, slog.String("userId", userID))
+			}
+			if sourceType := r.Header.Get("Source-Type"); sourceType != "" {
+				attrs = append(attrs, slog.String("source_type", sourceType))
+			}
+
+			rl.mu.Lock()
+			hasOutcome := false
+			for _, a := range rl.attrs {
+				if a.Key == "outcome" {
+					hasOutcome = true
+				}
+			}
+			attrs = append(attrs, rl.attrs...)
+			rl.mu.Unlock()
+			if !hasOutcome {
+				attrs = append(attrs, slog.String("outcome", outcomeForStatus(rec.status)))
+			}
+
+			level := slog.LevelInfo
+			if rec.status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+			logger.LogAttrs(ctx, level, "request", attrs...)
+		})
+	}
+}
+
+func outcomeForStatus(status int) string {
+	switch {
+	case status >= http.StatusInternalServerError:
+		return "error"
+	case status >= http.StatusBadRequest:
+		return "rejected"
+	default:
+		return "success"
+	}
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
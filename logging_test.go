@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactDSN(t *testing.T) {
+	assert.Equal(t,
+		"host=db port=5432 user=golang_user password=REDACTED dbname=golang_db sslmode=disable",
+		redactDSN("host=db port=5432 user=golang_user password=golang_pass dbname=golang_db sslmode=disable"))
+	assert.Equal(t,
+		"host=db password=REDACTED dbname=x",
+		redactDSN("host=db password='p a\\'ss' dbname=x"))
+	assert.Equal(t,
+		"postgres://golang_user:REDACTED@db:5432/golang_db?sslmode=disable",
+		redactDSN("postgres://golang_user:s3cr3t@db:5432/golang_db?sslmode=disable"))
+}
+
+func TestNewLogger_RedactsSecrets(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, "info", "json")
+	assert.NoError(t, err)
+
+	logger.Info("connecting", "dsn", "host=db password=golang_pass", "password", "golang_pass")
+
+	assert.NotContains(t, buf.String(), "golang_pass")
+	assert.Contains(t, buf.String(), "REDACTED")
+}
+
+func TestNewLogger_InvalidConfig(t *testing.T) {
+	_, err := NewLogger(&bytes.Buffer{}, "loud", "json")
+	assert.Error(t, err)
+	_, err = NewLogger(&bytes.Buffer{}, "info", "xml")
+	assert.Error(t, err)
+}
+
+func TestLoggingMiddleware_AccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, "info", "json")
+	assert.NoError(t, err)
+
+	store := NewMockStore()
+	store.Users[1] = 1.0
+	server := NewAPIServer(store, WithLogger(logger))
+	router := server.Router()
+
+	body, _ := json.Marshal(TransactionRequest{State: "lose", Amount: "5.00", TransactionID: "txn-log"})
+	req := httptest.NewRequest("POST", "/user/1/transaction", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Source-Type", "payment")
+	req.Header.Set(requestIDHeader, "req-123")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, "req-123", rr.Header().Get(requestIDHeader))
+
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "request", entry["msg"])
+	assert.Equal(t, "req-123", entry["request_id"])
+	assert.Equal(t, "1", entry["userId"])
+	assert.Equal(t, "txn-log", entry["transactionId"])
+	assert.Equal(t, "payment", entry["source_type"])
+	assert.Equal(t, "insufficient_funds", entry["outcome"])
+	assert.Equal(t, float64(400), entry["status"])
+	assert.Contains(t, entry, "latency_ms")
+	assert.Len(t, entry["trace_id"], 32)
+}
+
+func TestLoggingMiddleware_GeneratesRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, "info", "json")
+	assert.NoError(t, err)
+	router := NewAPIServer(NewMockStore(), WithLogger(logger)).Router()
+
+	req := httptest.NewRequest("GET", "/user/1/balance", nil)
+	req.Header.Set(requestIDHeader, "bad id with spaces")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Len(t, rr.Header().Get(requestIDHeader), 32)
+	assert.Contains(t, buf.String(), `"outcome":"success"`)
+}
@@ -1,46 +1,265 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
-	host := flag.String("dbhost", getEnv("DB_HOST", "db"), "Database host")
-	port := flag.Int("dbport", getEnvAsInt("DB_PORT", 5432), "Database port")
-	user := flag.String("dbuser", getEnv("DB_USER", "golang_user"), "Database user")
-	password := flag.String("dbpass", getEnv("DB_PASS", "golang_pass"), "Database password")
-	dbname := flag.String("dbname", getEnv("DB_NAME", "golang_db"), "Database name")
+	storeKind := flag.String("store", getEnv("STORE", "postgres"), "Storage backend: postgres, memory or sqlite")
+	dsn := flag.String("dsn", getEnv("DATABASE_URL", ""), "Database DSN: a postgres:// URL, a keyword/value string or sqlite:<path>")
+
+	pgCfg := DefaultPostgresConfig()
+	flag.StringVar(&pgCfg.Host, "dbhost", getEnv("DB_HOST", pgCfg.Host), "Database host")
+	flag.IntVar(&pgCfg.Port, "dbport", getEnvAsInt("DB_PORT", pgCfg.Port), "Database port")
+	flag.StringVar(&pgCfg.User, "dbuser", getEnv("DB_USER", "golang_user"), "Database user")
+	flag.StringVar(&pgCfg.Password, "dbpass", getEnv("DB_PASS", "golang_pass"), "Database password, prefer -dbpass-file as flags are visible in ps")
+	flag.StringVar(&pgCfg.PasswordFile, "dbpass-file", getEnv("DB_PASS_FILE", ""), "File holding the database password, e.g. a Docker secret")
+	flag.StringVar(&pgCfg.DBName, "dbname", getEnv("DB_NAME", "golang_db"), "Database name")
+	flag.StringVar(&pgCfg.SSLMode, "dbsslmode", getEnv("DB_SSLMODE", ""), "SSL mode: disable, require, verify-ca or verify-full (default disable without -dsn)")
+	flag.StringVar(&pgCfg.SSLRootCert, "dbsslrootcert", getEnv("DB_SSLROOTCERT", ""), "Root certificate file used to verify the server")
+	flag.DurationVar(&pgCfg.StatementTimeout, "dbstatement-timeout", getEnvAsDuration("DB_STATEMENT_TIMEOUT", 0), "Server-side statement_timeout, 0 keeps the server default")
+	flag.DurationVar(&pgCfg.LockTimeout, "dblock-timeout", getEnvAsDuration("DB_LOCK_TIMEOUT", 0), "Server-side lock_timeout, 0 keeps the server default")
+	flag.IntVar(&pgCfg.MaxOpenConns, "dbmax-open-conns", getEnvAsInt("DB_MAX_OPEN_CONNS", pgCfg.MaxOpenConns), "Maximum open connections")
+	flag.IntVar(&pgCfg.MaxIdleConns, "dbmax-idle-conns", getEnvAsInt("DB_MAX_IDLE_CONNS", pgCfg.MaxIdleConns), "Maximum idle connections")
+	flag.DurationVar(&pgCfg.ConnMaxLifetime, "dbconn-max-lifetime", getEnvAsDuration("DB_CONN_MAX_LIFETIME", 0), "Maximum connection lifetime, 0 for unlimited")
+	flag.DurationVar(&pgCfg.ConnMaxIdleTime, "dbconn-max-idle-time", getEnvAsDuration("DB_CONN_MAX_IDLE_TIME", 0), "Maximum connection idle time, 0 for unlimited")
+	flag.StringVar(&pgCfg.ReplicaDSN, "replica-dsn", getEnv("DATABASE_REPLICA_URL", ""), "DSN of a read replica serving balance reads")
+	flag.DurationVar(&pgCfg.MaxReplicaLag, "dbmax-replica-lag", getEnvAsDuration("DB_MAX_REPLICA_LAG", pgCfg.MaxReplicaLag), "Replication lag above which reads go to the primary")
+	flag.StringVar(&pgCfg.Locking, "dblocking", getEnv("DB_LOCKING", pgCfg.Locking), "Balance update strategy: pessimistic (row locks), optimistic (version compare-and-swap) or conditional (single statement)")
+	flag.IntVar(&pgCfg.CASRetry.MaxAttempts, "dbcas-retries", getEnvAsInt("DB_CAS_RETRIES", pgCfg.CASRetry.MaxAttempts), "Attempts of an optimistic balance update that loses races")
+	flag.IntVar(&pgCfg.ConnectRetry.MaxAttempts, "dbconnect-retries", getEnvAsInt("DB_CONNECT_RETRIES", pgCfg.ConnectRetry.MaxAttempts), "Connection attempts on startup before giving up")
+	flag.DurationVar(&pgCfg.ConnectRetry.InitialBackoff, "dbconnect-backoff", getEnvAsDuration("DB_CONNECT_BACKOFF", pgCfg.ConnectRetry.InitialBackoff), "Initial backoff between startup connection attempts")
+	flag.DurationVar(&pgCfg.ConnectRetry.MaxBackoff, "dbconnect-max-backoff", getEnvAsDuration("DB_CONNECT_MAX_BACKOFF", pgCfg.ConnectRetry.MaxBackoff), "Maximum backoff between startup connection attempts")
+	flag.IntVar(&pgCfg.TxRetry.MaxAttempts, "dbtx-retries", getEnvAsInt("DB_TX_RETRIES", pgCfg.TxRetry.MaxAttempts), "Attempts for a transaction failing with a transient error, 1 disables retries")
+	cacheSize := flag.Int("cache-size", getEnvAsInt("CACHE_SIZE", 0), "Balances kept in the in-process read cache, 0 disables it; only safe with a single instance")
+	cacheTTL := flag.Duration("cache-ttl", getEnvAsDuration("CACHE_TTL", 30*time.Second), "How long a cached balance may be served, 0 for no limit")
 	addr := flag.String("addr", getEnv("APP_ADDR", ":8080"), "Server address")
+	grpcAddr := flag.String("grpc-addr", getEnv("GRPC_ADDR", ""), "gRPC server address, empty disables the gRPC API")
 	seed := flag.Bool("seed", false, "Seed predefined users")
+	migrate := flag.String("migrate", "", "Run a migration command and exit: status, up or down N")
+	requestTimeout := flag.Duration("request-timeout", getEnvAsDuration("REQUEST_TIMEOUT", defaultRequestTimeout), "Deadline budget for the storage calls of one request")
+	maxAmount := flag.Float64("max-amount", getEnvAsFloat("MAX_AMOUNT", defaultMaxAmount), "Largest amount of a single transaction, 0 for no limit")
+	legacySunset := flag.String("legacy-sunset", getEnv("LEGACY_SUNSET", defaultLegacySunset.Format(time.DateOnly)), "Date announced in the Sunset header of the unversioned API paths, as YYYY-MM-DD")
+	var rateLimits RateLimitConfig
+	flag.Float64Var(&rateLimits.SourceRate, "rate-limit-source", getEnvAsFloat("RATE_LIMIT_SOURCE", 0), "Transactions per second accepted from each Source-Type, 0 for no limit")
+	flag.IntVar(&rateLimits.SourceBurst, "rate-limit-source-burst", getEnvAsInt("RATE_LIMIT_SOURCE_BURST", 0), "Transactions a Source-Type may send at once above its rate, 0 for one second's worth")
+	sourceRates := flag.String("rate-limit-sources", getEnv("RATE_LIMIT_SOURCES", ""), "Per Source-Type rates overriding -rate-limit-source, as source=rate pairs")
+	flag.Float64Var(&rateLimits.UserRate, "rate-limit-user", getEnvAsFloat("RATE_LIMIT_USER", 0), "Transactions per second accepted for each user, 0 for no limit")
+	flag.IntVar(&rateLimits.UserBurst, "rate-limit-user-burst", getEnvAsInt("RATE_LIMIT_USER_BURST", 0), "Transactions of a user accepted at once above the rate, 0 for one second's worth")
+	var quotas QuotaConfig
+	flag.Int64Var(&quotas.DailyCount, "quota-daily-count", int64(getEnvAsInt("QUOTA_DAILY_COUNT", 0)), "Transactions each Source-Type may send per UTC day, 0 for no quota")
+	flag.Float64Var(&quotas.DailyAmount, "quota-daily-amount", getEnvAsFloat("QUOTA_DAILY_AMOUNT", 0), "Total amount each Source-Type may send per UTC day, 0 for no quota")
+	userQueueDepth := flag.Int("user-queue-depth", getEnvAsInt("USER_QUEUE_DEPTH", defaultUserQueueDepth), "Transactions of one user queued before answering 429, 0 disables per-user queueing")
+	outboxPublisher := flag.String("outbox-publisher", getEnv("OUTBOX_PUBLISHER", "none"), "Balance event publisher: none, stdout, file or webhook (postgres store only)")
+	outboxFile := flag.String("outbox-file", getEnv("OUTBOX_FILE", "events.jsonl"), "File used by the file event publisher")
+	outboxURL := flag.String("outbox-webhook-url", getEnv("OUTBOX_WEBHOOK_URL", ""), "URL the webhook event publisher posts to")
+	outboxCfg := DefaultOutboxConfig()
+	flag.DurationVar(&outboxCfg.PollInterval, "outbox-poll-interval", getEnvAsDuration("OUTBOX_POLL_INTERVAL", outboxCfg.PollInterval), "How often the outbox is polled once drained")
+	flag.IntVar(&outboxCfg.MaxAttempts, "outbox-max-attempts", getEnvAsInt("OUTBOX_MAX_ATTEMPTS", outboxCfg.MaxAttempts), "Delivery attempts before an event is dead-lettered")
+	webhooksEnabled := flag.Bool("webhooks", getEnv("WEBHOOKS", "false") == "true", "Enable partner webhook subscriptions (postgres store only)")
+	webhookCfg := DefaultWebhookConfig()
+	flag.IntVar(&webhookCfg.MaxAttempts, "webhook-max-attempts", getEnvAsInt("WEBHOOK_MAX_ATTEMPTS", webhookCfg.MaxAttempts), "Delivery attempts before a webhook is marked failed")
+	flag.StringVar(&webhookCfg.AdminToken, "webhook-admin-token", getEnv("WEBHOOK_ADMIN_TOKEN", ""), "Bearer token of the webhook subscription and delivery endpoints, prefer WEBHOOK_ADMIN_TOKEN as flags are visible in ps")
+	flag.BoolVar(&webhookCfg.AllowPrivateTargets, "webhook-allow-private-targets", getEnv("WEBHOOK_ALLOW_PRIVATE_TARGETS", "false") == "true", "Let webhook subscriptions reach loopback, private and link-local addresses")
+	streamEnabled := flag.Bool("stream", getEnv("STREAM", "false") == "true", "Enable balance streams, which make every postgres write send a NOTIFY")
+	streamCfg := DefaultStreamConfig()
+	flag.IntVar(&streamCfg.MaxConns, "stream-max-conns", getEnvAsInt("STREAM_MAX_CONNS", streamCfg.MaxConns), "Open balance streams allowed")
+	flag.IntVar(&streamCfg.MaxConnsPerUser, "stream-max-conns-per-user", getEnvAsInt("STREAM_MAX_CONNS_PER_USER", streamCfg.MaxConnsPerUser), "Open balance streams allowed per user")
+	flag.DurationVar(&streamCfg.Heartbeat, "stream-heartbeat", getEnvAsDuration("STREAM_HEARTBEAT", streamCfg.Heartbeat), "Interval of the comments keeping idle balance streams open")
+	socketCfg := DefaultSocketConfig()
+	socketTokens := flag.String("ws-tokens", getEnv("WS_PROVIDER_TOKENS", ""), "Provider WebSocket tokens as provider=token pairs, prefer -ws-tokens-file as flags are visible in ps")
+	socketTokensFile := flag.String("ws-tokens-file", getEnv("WS_PROVIDER_TOKENS_FILE", ""), "File holding one provider=token pair per line")
+	flag.IntVar(&socketCfg.Window, "ws-window", getEnvAsInt("WS_WINDOW", socketCfg.Window), "Frames a provider may send ahead of their acks")
+	traceExporter := flag.String("trace-exporter", getEnv("TRACE_EXPORTER", "none"), "Span exporter: none, stdout or file")
+	traceFile := flag.String("trace-file", getEnv("TRACE_FILE", "traces.jsonl"), "File used by the file span exporter")
+	logLevel := flag.String("log-level", getEnv("LOG_LEVEL", "info"), "Log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", getEnv("LOG_FORMAT", "json"), "Log format: json or text")
 
 	flag.Parse()
 
-	store, err := NewPostgresStore(*host, *port, *user, *password, *dbname)
+	logger, err := NewLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	switch {
+	case strings.HasPrefix(*dsn, "sqlite:"):
+		*storeKind = "sqlite"
+	case *dsn != "":
+		*storeKind = "postgres"
+		pgCfg.DSN = *dsn
+	}
+
+	publisher, err := newPublisher(*outboxPublisher, *outboxFile, *outboxURL)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		fatal("failed to set up the outbox publisher", err)
+	}
+	if c, ok := publisher.(io.Closer); ok {
+		defer c.Close()
+	}
+	// webhooks learn about balance changes through the outbox
+	pgCfg.Outbox = publisher != nil || *webhooksEnabled
+	// balance changes are only notified when streams listen for them
+	pgCfg.Notify = *streamEnabled && streamCfg.MaxConns > 0
+
+	var store Storage
+	var pgStore *PostgresStore
+	switch *storeKind {
+	case "sqlite":
+		path := strings.TrimPrefix(strings.TrimPrefix(*dsn, "sqlite:"), "//")
+		if path == "" {
+			path = "balance.db"
+		}
+		lite, err := NewSQLiteStore(path)
+		if err != nil {
+			fatal("failed to open sqlite database", err)
+		}
+		store = lite
+	case "postgres":
+		pg, err := NewPostgresStore(pgCfg)
+		if err != nil {
+			fatal("failed to connect to database", err)
+		}
+		store, pgStore = pg, pg
+	case "memory":
+		logger.Warn("using in-memory storage, balances are lost on restart")
+		store = NewMemoryStore()
+	default:
+		fatal("invalid storage backend", fmt.Errorf("unknown store %q, expected postgres, memory or sqlite", *storeKind))
 	}
 	defer store.Close()
 
-	if err := store.Init(); err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+	ctx := context.Background()
+	if *migrate != "" {
+		var err error
+		switch st := store.(type) {
+		case *PostgresStore:
+			err = runMigrateCommand(ctx, st.Db, dialectPostgres, *migrate, flag.Args(), os.Stdout)
+		case *SQLiteStore:
+			err = runMigrateCommand(ctx, st.Db, dialectSQLite, *migrate, flag.Args(), os.Stdout)
+		default:
+			err = fmt.Errorf("the %s store has no schema to migrate", *storeKind)
+		}
+		if err != nil {
+			fatal("migration failed", err)
+		}
+		return
+	}
+
+	if err := store.Init(ctx); err != nil {
+		fatal("failed to initialize database", err)
+	}
+
+	if pgCfg.Outbox && pgStore == nil {
+		fatal("invalid outbox configuration", fmt.Errorf("events and webhooks need the postgres store, not %s", *storeKind))
+	}
+	var webhooks *WebhookService
+	if *webhooksEnabled {
+		if webhookCfg.AdminToken == "" {
+			fatal("invalid webhook configuration", errors.New("webhooks need an admin token"))
+		}
+		webhooks = NewWebhookService(pgStore.Db, webhookCfg)
+		if publisher != nil {
+			publisher = multiPublisher{publisher, webhooks}
+		} else {
+			publisher = webhooks
+		}
+		go webhooks.Run(ctx)
+	}
+	if publisher != nil {
+		go NewOutboxRelay(pgStore.Db, publisher, outboxCfg).Run(ctx)
+	}
+
+	var hub *BalanceHub
+	if *streamEnabled && streamCfg.MaxConns > 0 {
+		hub = NewBalanceHub(streamCfg)
+		if pgStore != nil {
+			connStr, err := pgCfg.ConnString()
+			if err == nil {
+				err = ListenBalanceChanges(ctx, connStr, hub)
+			}
+			if err != nil {
+				fatal("failed to listen for balance changes", err)
+			}
+		} else {
+			store = NewBroadcastStore(store, hub)
+		}
+	}
+
+	if *cacheSize > 0 {
+		store = NewCachedStore(store, NewLRUCache(*cacheSize, *cacheTTL))
 	}
 
 	if *seed {
-		if err := store.EnsurePredefinedUsers(); err != nil {
-			log.Fatalf("Failed to seed users: %v", err)
+		if err := store.EnsurePredefinedUsers(ctx); err != nil {
+			fatal("failed to seed users", err)
 		}
 		fmt.Println("Predefined users seeded successfully.")
 		return
 	}
 
-	server := NewAPIServer(store)
+	exporter, err := newSpanExporter(*traceExporter, *traceFile)
+	if err != nil {
+		fatal("failed to set up tracing", err)
+	}
+	tracer := NewTracer(exporter)
+	defer tracer.Shutdown()
+
+	sunset, err := time.Parse(time.DateOnly, *legacySunset)
+	if err != nil {
+		fatal("invalid legacy sunset date", err)
+	}
+
+	if rateLimits.Sources, err = parseSourceRates(*sourceRates); err != nil {
+		fatal("invalid source rate limits", err)
+	}
+
+	opts := []ServerOption{WithTracer(tracer), WithLogger(logger), WithRequestTimeout(*requestTimeout), WithMaxAmount(*maxAmount), WithLegacySunset(sunset), WithRateLimits(rateLimits), WithDailyQuotas(quotas), WithUserQueueDepth(*userQueueDepth), WithWebhooks(webhooks), WithBalanceStream(hub)}
+	tokenSpec := *socketTokens
+	if *socketTokensFile != "" {
+		data, err := os.ReadFile(*socketTokensFile)
+		if err != nil {
+			fatal("failed to read provider tokens", err)
+		}
+		tokenSpec = string(data)
+	}
+	if tokenSpec != "" {
+		if socketCfg.Tokens, err = parseProviderTokens(tokenSpec); err != nil {
+			fatal("invalid provider tokens", err)
+		}
+		if socketCfg.Window < 1 {
+			fatal("invalid socket window", fmt.Errorf("-ws-window must be at least 1, got %d", socketCfg.Window))
+		}
+		opts = append(opts, WithTransactionSocket(socketCfg))
+	}
+
+	server := NewAPIServer(store, opts...)
+	if *grpcAddr != "" {
+		go func() {
+			if err := server.RunGRPC(*grpcAddr); err != nil {
+				fatal("grpc server failed", err)
+			}
+		}()
+	}
 	server.Run(*addr)
 }
 
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
 func getEnv(key string, defaultVal string) string {
 	if value, exists := os.LookupEnv(key); exists {
 		return value
@@ -56,3 +275,21 @@ func getEnvAsInt(name string, defaultVal int) int {
 	}
 	return defaultVal
 }
+
+func getEnvAsFloat(name string, defaultVal float64) float64 {
+	if valueStr, exists := os.LookupEnv(name); exists {
+		if value, err := strconv.ParseFloat(valueStr, 64); err == nil {
+			return value
+		}
+	}
+	return defaultVal
+}
+
+func getEnvAsDuration(name string, defaultVal time.Duration) time.Duration {
+	if valueStr, exists := os.LookupEnv(name); exists {
+		if value, err := time.ParseDuration(valueStr); err == nil {
+			return value
+		}
+	}
+	return defaultVal
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryShards is the number of independently locked user partitions
+const memoryShards = 32
+
+// maxBalanceCents mirrors the NUMERIC(12, 2) limit of the users table
+const maxBalanceCents = 1e12 - 1
+
+var errBalanceOverflow = errors.New("numeric field overflow")
+
+// MemoryStore is a goroutine-safe Storage kept entirely in memory. It follows
+// the same rules as PostgresStore: balances are stored in cents, can't go
+// negative, transaction IDs are unique and must reference an existing user.
+type MemoryStore struct {
+	shards [memoryShards]memoryShard
+
+	txMu         sync.RWMutex
+	transactions map[string]Transaction
+	nextTxID     int64
+
+	quotaMu sync.Mutex
+	quotas  map[memoryQuotaKey]*memoryQuota
+}
+
+type memoryQuotaKey struct {
+	sourceType string
+	day        string
+}
+
+type memoryQuota struct {
+	count       int64
+	amountCents int64
+}
+
+type memoryShard struct {
+	mu    sync.Mutex
+	users map[uint64]*memoryUser
+}
+
+type memoryUser struct {
+	balanceCents int64
+	created      time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{
+		transactions: make(map[string]Transaction),
+		quotas:       make(map[memoryQuotaKey]*memoryQuota),
+	}
+	for i := range s.shards {
+		s.shards[i].users = make(map[uint64]*memoryUser)
+	}
+	return s
+}
+
+func (s *MemoryStore) shard(userID uint64) *memoryShard {
+	return &s.shards[userID%memoryShards]
+}
+
+func (s *MemoryStore) Init(ctx context.Context) error {
+	return s.EnsurePredefinedUsers(ctx)
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) EnsurePredefinedUsers(ctx context.Context) error {
+	for _, id := range []uint64{1, 2, 3} {
+		sh := s.shard(id)
+		sh.mu.Lock()
+		if _, ok := sh.users[id]; !ok {
+			sh.users[id] = &memoryUser{created: timeNowUTC()}
+		}
+		sh.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetUserBalance(ctx context.Context, userID uint64) (float64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	sh := s.shard(userID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	user, ok := sh.users[userID]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+	return centsToAmount(user.balanceCents), nil
+}
+
+// UpdateUserBalance updates the user's balance by a delta
+func (s *MemoryStore) UpdateUserBalance(ctx context.Context, userID uint64, delta float64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sh := s.shard(userID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	user, ok := sh.users[userID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	newBalance := user.balanceCents + amountToCents(delta)
+	if newBalance < 0 {
+		return ErrInsufficientFunds
+	}
+	if newBalance > maxBalanceCents {
+		return errBalanceOverflow
+	}
+	user.balanceCents = newBalance
+	return nil
+}
+
+func (s *MemoryStore) CreateTransaction(ctx context.Context, tx Transaction) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !s.userExists(tx.UserID) {
+		return errors.New("transaction references unknown user")
+	}
+
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	if _, exists := s.transactions[tx.TransactionID]; exists {
+		return errors.New("duplicate transaction")
+	}
+	s.nextTxID++
+	tx.ID = s.nextTxID
+	tx.Amount = roundCents(tx.Amount)
+	s.transactions[tx.TransactionID] = tx
+	return nil
+}
+
+// ApplyTransaction records the transaction and updates the balance atomically,
+// holding the user's shard lock for the whole unit
+func (s *MemoryStore) ApplyTransaction(ctx context.Context, t Transaction, delta float64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sh := s.shard(t.UserID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	user, ok := sh.users[t.UserID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	newBalance := user.balanceCents + amountToCents(delta)
+	if newBalance < 0 {
+		return ErrInsufficientFunds
+	}
+	if newBalance > maxBalanceCents {
+		return errBalanceOverflow
+	}
+
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	if _, exists := s.transactions[t.TransactionID]; exists {
+		return ErrDuplicateTransaction
+	}
+	s.nextTxID++
+	t.ID = s.nextTxID
+	t.Amount = roundCents(t.Amount)
+	s.transactions[t.TransactionID] = t
+	user.balanceCents = newBalance
+	return nil
+}
+
+func (s *MemoryStore) GetTransactionByID(ctx context.Context, transactionID string) (*Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.txMu.RLock()
+	defer s.txMu.RUnlock()
+
+	tx, ok := s.transactions[transactionID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &tx, nil
+}
+
+func (s *MemoryStore) ListTransactions(ctx context.Context, userID uint64, beforeID int64, limit int) ([]Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.txMu.RLock()
+	txs := []Transaction{}
+	for _, tx := range s.transactions {
+		if tx.UserID == userID && (beforeID == 0 || tx.ID < beforeID) {
+			txs = append(txs, tx)
+		}
+	}
+	s.txMu.RUnlock()
+
+	sort.Slice(txs, func(i, j int) bool { return txs[i].ID > txs[j].ID })
+	if len(txs) > limit {
+		txs = txs[:limit]
+	}
+	return txs, nil
+}
+
+func (s *MemoryStore) ConsumeQuota(ctx context.Context, sourceType string, day time.Time, amount float64, quota QuotaConfig) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+
+	key := memoryQuotaKey{sourceType, day.UTC().Format(time.DateOnly)}
+	q, ok := s.quotas[key]
+	if !ok {
+		q = &memoryQuota{}
+		s.quotas[key] = q
+	}
+	cents := amountToCents(amount)
+	if quotaExceededBy(quota, q.count+1, q.amountCents+cents) {
+		return ErrQuotaExceeded
+	}
+	q.count++
+	q.amountCents += cents
+	return nil
+}
+
+func (s *MemoryStore) ReleaseQuota(ctx context.Context, sourceType string, day time.Time, amount float64) error {
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+
+	if q, ok := s.quotas[memoryQuotaKey{sourceType, day.UTC().Format(time.DateOnly)}]; ok && q.count > 0 {
+		q.count--
+		q.amountCents -= amountToCents(amount)
+	}
+	return nil
+}
+
+func (s *MemoryStore) userExists(userID uint64) bool {
+	sh := s.shard(userID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	_, ok := sh.users[userID]
+	return ok
+}
+
+func amountToCents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+func centsToAmount(cents int64) float64 {
+	return float64(cents) / 100
+}
+
+func roundCents(amount float64) float64 {
+	return centsToAmount(amountToCents(amount))
+}
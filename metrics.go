@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultBuckets mirrors the Prometheus client default latency buckets (seconds)
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics holds the service metrics and renders them in the Prometheus
+// text exposition format (version 0.0.4)
+type Metrics struct {
+	httpRequests    *metricVec
+	httpDuration    *histogramVec
+	transactions    *metricVec
+	amounts         *metricVec
+	replays         *metricVec
+	insufficientBal *metricVec
+	queueRejected   *metricVec
+	limited         *metricVec
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		httpRequests: newMetricVec("http_requests_total", "counter",
+			"Total HTTP requests by route, method and status.", "route", "method", "status"),
+		httpDuration: newHistogramVec("http_request_duration_seconds",
+			"HTTP request latency by route, method and status.", defaultBuckets, "route", "method", "status"),
+		transactions: newMetricVec("balance_transactions_total", "counter",
+			"Applied balance transactions by state and source type.", "state", "source_type"),
+		amounts: newMetricVec("balance_transaction_amount_total", "counter",
+			"Sum of applied transaction amounts by state and source type.", "state", "source_type"),
+		replays: newMetricVec("balance_idempotent_replays_total", "counter",
+			"Transactions answered as already processed by source type.", "source_type"),
+		insufficientBal: newMetricVec("balance_insufficient_funds_total", "counter",
+			"Transactions rejected because the balance would go negative, by source type.", "source_type"),
+		queueRejected: newMetricVec("balance_queue_rejected_total", "counter",
+			"Transactions answered 429 because the user's queue was full, by source type.", "source_type"),
+		limited: newMetricVec("balance_limited_total", "counter",
+			"Transactions refused by a rate limit or daily quota, by source type and limit.", "source_type", "limit"),
+	}
+}
+
+// Middleware records request counts and latency per route template
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := "unknown"
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tpl, err := cr.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		status := strconv.Itoa(rec.status)
+		m.httpRequests.add(1, route, r.Method, status)
+		m.httpDuration.observe(time.Since(start).Seconds(), route, r.Method, status)
+	})
+}
+
+func (m *Metrics) ObserveTransaction(state, sourceType string, amount float64) {
+	m.transactions.add(1, state, sourceType)
+	m.amounts.add(amount, state, sourceType)
+}
+
+func (m *Metrics) ObserveReplay(sourceType string) {
+	m.replays.add(1, sourceType)
+}
+
+func (m *Metrics) ObserveInsufficientFunds(sourceType string) {
+	m.insufficientBal.add(1, sourceType)
+}
+
+func (m *Metrics) ObserveQueueRejected(sourceType string) {
+	m.queueRejected.add(1, sourceType)
+}
+
+func (m *Metrics) ObserveLimited(sourceType, limit string) {
+	m.limited.add(1, sourceType, limit)
+}
+
+// Render writes every metric family in the text exposition format
+func (m *Metrics) Render(w io.Writer) {
+	m.httpRequests.writeTo(w)
+	m.httpDuration.writeTo(w)
+	m.transactions.writeTo(w)
+	m.amounts.writeTo(w)
+	m.replays.writeTo(w)
+	m.insufficientBal.writeTo(w)
+	m.queueRejected.writeTo(w)
+	m.limited.writeTo(w)
+}
+
+// HandleMetrics serves GET /metrics
+func (s *APIServer) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	s.metrics.Render(w)
+
+	if hc, ok := healthChecker(s.store); ok {
+		stats := hc.Stats()
+		writeGauge(w, "db_pool_max_open_connections", "Maximum number of open connections to the database.", float64(stats.MaxOpenConnections))
+		writeGauge(w, "db_pool_open_connections", "Established connections, both in use and idle.", float64(stats.OpenConnections))
+		writeGauge(w, "db_pool_in_use_connections", "Connections currently in use.", float64(stats.InUse))
+		writeGauge(w, "db_pool_idle_connections", "Idle connections.", float64(stats.Idle))
+		writeCounter(w, "db_pool_wait_count_total", "Total connections waited for.", float64(stats.WaitCount))
+		writeCounter(w, "db_pool_wait_duration_seconds_total", "Total time blocked waiting for a new connection.", stats.WaitDuration.Seconds())
+	}
+
+	if cs, ok := s.store.(interface{ CacheStats() CacheStats }); ok {
+		stats := cs.CacheStats()
+		writeCounter(w, "balance_cache_hits_total", "Balance reads served from the cache.", float64(stats.Hits))
+		writeCounter(w, "balance_cache_misses_total", "Balance reads that went to the store.", float64(stats.Misses))
+		if stats.Entries >= 0 {
+			writeGauge(w, "balance_cache_entries", "Balances currently cached.", float64(stats.Entries))
+		}
+	}
+
+	if s.stream != nil {
+		writeGauge(w, "balance_streams_open", "Open balance event streams.", float64(s.stream.Conns()))
+	}
+
+	if s.sockets != nil {
+		writeGauge(w, "provider_sockets_open", "Open provider transaction sockets.", float64(s.sockets.open.Load()))
+	}
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the Flusher of streaming handlers
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Hijack lets the WebSocket upgrade take over the connection
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+type metricVec struct {
+	name   string
+	kind   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+}
+
+func newMetricVec(name, kind, help string, labels ...string) *metricVec {
+	return &metricVec{
+		name:   name,
+		kind:   kind,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*metricSeries),
+	}
+}
+
+func (v *metricVec) add(delta float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: labelValues}
+		v.series[key] = s
+	}
+	s.value += delta
+}
+
+func (v *metricVec) writeTo(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	for _, key := range sortedKeys(v.series) {
+		s := v.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labelValues), formatFloat(s.value))
+	}
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64 // cumulative is computed on render
+	count       uint64
+	sum         float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+}
+
+func (v *histogramVec) observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(v.buckets))}
+		v.series[key] = s
+	}
+	for i, upper := range v.buckets {
+		if value <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (v *histogramVec) writeTo(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", v.name, v.help, v.name)
+	for _, key := range sortedKeys(v.series) {
+		s := v.series[key]
+		labels := append([]string{}, v.labels...)
+		labels = append(labels, "le")
+
+		var cumulative uint64
+		for i, upper := range v.buckets {
+			cumulative += s.counts[i]
+			values := append(append([]string{}, s.labelValues...), formatFloat(upper))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(labels, values), cumulative)
+		}
+		values := append(append([]string{}, s.labelValues...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(labels, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatLabels(v.labels, s.labelValues), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(v.labels, s.labelValues), s.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+func writeCounter(w io.Writer, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
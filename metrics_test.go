@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics_TextExposition(t *testing.T) {
+	m := NewMetrics()
+	m.ObserveTransaction("win", "game", 10.15)
+	m.ObserveTransaction("win", "game", 4.85)
+	m.ObserveReplay("server")
+	m.httpDuration.observe(0.02, "/user/{userId}/balance", "GET", "200")
+
+	var buf bytes.Buffer
+	m.Render(&buf)
+	out := buf.String()
+
+	assert.Contains(t, out, "# TYPE balance_transactions_total counter\n")
+	assert.Contains(t, out, `balance_transactions_total{state="win",source_type="game"} 2`)
+	assert.Contains(t, out, `balance_transaction_amount_total{state="win",source_type="game"} 15`)
+	assert.Contains(t, out, `balance_idempotent_replays_total{source_type="server"} 1`)
+	assert.Contains(t, out, `http_request_duration_seconds_bucket{route="/user/{userId}/balance",method="GET",status="200",le="0.01"} 0`)
+	assert.Contains(t, out, `http_request_duration_seconds_bucket{route="/user/{userId}/balance",method="GET",status="200",le="0.025"} 1`)
+	assert.Contains(t, out, `http_request_duration_seconds_bucket{route="/user/{userId}/balance",method="GET",status="200",le="+Inf"} 1`)
+	assert.Contains(t, out, `http_request_duration_seconds_count{route="/user/{userId}/balance",method="GET",status="200"} 1`)
+}
+
+func TestMetrics_EscapesLabelValues(t *testing.T) {
+	m := NewMetrics()
+	m.ObserveReplay("ga\"me\n")
+
+	var buf bytes.Buffer
+	m.Render(&buf)
+
+	assert.Contains(t, buf.String(), `balance_idempotent_replays_total{source_type="ga\"me\n"} 1`)
+}
+
+func TestHandleMetrics_CountsTransactions(t *testing.T) {
+	store := NewMockStore()
+	store.Users[1] = 5.0
+	server := NewAPIServer(store)
+	router := server.Router()
+
+	send := func(state, amount, txID string) {
+		body, _ := json.Marshal(TransactionRequest{State: state, Amount: amount, TransactionID: txID})
+		req := httptest.NewRequest("POST", "/user/1/transaction", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Source-Type", "game")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	send("win", "1.00", "txn-m1")
+	send("win", "1.00", "txn-m1")
+	send("lose", "100.00", "txn-m2")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+	out := rr.Body.String()
+	assert.Contains(t, out, `balance_transactions_total{state="win",source_type="game"} 1`)
+	assert.Contains(t, out, `balance_idempotent_replays_total{source_type="game"} 1`)
+	assert.Contains(t, out, `balance_insufficient_funds_total{source_type="game"} 1`)
+	assert.Contains(t, out, `http_requests_total{route="/user/{userId}/transaction",method="POST",status="200"} 2`)
+	assert.Contains(t, out, `http_requests_total{route="/user/{userId}/transaction",method="POST",status="400"} 1`)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMigrations_Embedded(t *testing.T) {
+	for _, dialect := range []string{dialectPostgres, dialectSQLite} {
+		migrations, err := loadMigrations(migrationFiles, "migrations/"+dialect)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, migrations)
+
+		for i, m := range migrations {
+			assert.Equal(t, i+1, m.Version, "%s migration versions must be contiguous", dialect)
+			assert.NotEmpty(t, m.Up)
+			assert.NotEmpty(t, m.Down)
+		}
+		assert.Equal(t, expectedSchemaVersion, migrations[len(migrations)-1].Version,
+			"every dialect must reach the same schema version")
+	}
+}
+
+func TestLoadMigrations_Invalid(t *testing.T) {
+	_, err := loadMigrations(fstest.MapFS{
+		"m/0001_init.up.sql": {Data: []byte("SELECT 1")},
+	}, "m")
+	assert.ErrorContains(t, err, "needs both up and down")
+
+	_, err = loadMigrations(fstest.MapFS{
+		"m/init.sql": {Data: []byte("SELECT 1")},
+	}, "m")
+	assert.ErrorContains(t, err, "unexpected migration file")
+}
+
+func TestMigrator_UpAppliesPending(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	migrator := &Migrator{db: db, dialect: dialectPostgres, migrations: []Migration{
+		{Version: 1, Name: "first", Up: "CREATE TABLE a ()", Down: "DROP TABLE a"},
+		{Version: 2, Name: "second", Up: "CREATE TABLE b ()", Down: "DROP TABLE b"},
+	}}
+
+	mock.ExpectExec("SELECT pg_advisory_lock").WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE b").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").WithArgs(2, "second").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("SELECT pg_advisory_unlock").WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	applied, err := migrator.Up(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, applied, 1)
+	assert.Equal(t, 2, applied[0].Version)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrator_DownRevertsLatest(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	migrator := &Migrator{db: db, dialect: dialectPostgres, migrations: []Migration{
+		{Version: 1, Name: "first", Up: "CREATE TABLE a ()", Down: "DROP TABLE a"},
+		{Version: 2, Name: "second", Up: "CREATE TABLE b ()", Down: "DROP TABLE b"},
+	}}
+
+	mock.ExpectExec("SELECT pg_advisory_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()).AddRow(2, time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec("DROP TABLE b").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM schema_migrations").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("SELECT pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	reverted, err := migrator.Down(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Len(t, reverted, 1)
+	assert.Equal(t, 2, reverted[0].Version)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRunMigrateCommand_Status(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}))
+
+	var out bytes.Buffer
+	err = runMigrateCommand(context.Background(), db, dialectPostgres, "status", nil, &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "0001 create_users_and_transactions")
+	assert.Contains(t, out.String(), "pending")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRunMigrateCommand_InvalidArgs(t *testing.T) {
+	db, _, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	err = runMigrateCommand(context.Background(), db, dialectPostgres, "down", []string{"zero"}, &bytes.Buffer{})
+	assert.ErrorContains(t, err, "positive number")
+
+	err = runMigrateCommand(context.Background(), db, dialectPostgres, "sideways", nil, &bytes.Buffer{})
+	assert.ErrorContains(t, err, "unknown migrate command")
+}
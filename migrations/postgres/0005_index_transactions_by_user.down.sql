@@ -0,0 +1 @@
+DROP INDEX IF EXISTS transactions_user_id_id_idx;
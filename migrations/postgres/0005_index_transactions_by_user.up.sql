@@ -0,0 +1,2 @@
+-- serves the per-user transaction history, newest first
+CREATE INDEX IF NOT EXISTS transactions_user_id_id_idx ON transactions (user_id, id);
@@ -0,0 +1,8 @@
+-- daily usage of each source type, checked against the configured quotas
+CREATE TABLE IF NOT EXISTS source_quotas (
+	source_type VARCHAR(50) NOT NULL,
+	day DATE NOT NULL,   -- UTC
+	tx_count BIGINT NOT NULL DEFAULT 0,
+	amount_cents BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (source_type, day)
+);
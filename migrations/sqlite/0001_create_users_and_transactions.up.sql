@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS users (
+	user_id INTEGER PRIMARY KEY,
+	balance NUMERIC(12, 2) NOT NULL DEFAULT 0,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS transactions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	transaction_id VARCHAR(255) UNIQUE NOT NULL,
+	user_id BIGINT NOT NULL,
+	state VARCHAR(10) NOT NULL,   -- "win" or "lose"
+	amount NUMERIC(12, 2) NOT NULL,
+	source_type VARCHAR(50) NOT NULL,   -- "game", "server", "payment", etc.
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
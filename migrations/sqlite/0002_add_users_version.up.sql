@@ -0,0 +1,2 @@
+-- version is bumped by every balance update and backs optimistic locking
+ALTER TABLE users ADD COLUMN version INTEGER NOT NULL DEFAULT 0;
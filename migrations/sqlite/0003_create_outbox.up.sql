@@ -0,0 +1,27 @@
+-- outbox holds balance change events until the relay has published them
+CREATE TABLE IF NOT EXISTS outbox (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id BIGINT NOT NULL,
+	transaction_id VARCHAR(255),
+	delta NUMERIC(12, 2) NOT NULL,
+	balance NUMERIC(12, 2) NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_error TEXT
+);
+
+CREATE INDEX IF NOT EXISTS outbox_user_id_id_idx ON outbox (user_id, id);
+
+-- events that kept failing are moved here so they stop blocking the user's later events
+CREATE TABLE IF NOT EXISTS outbox_dead_letter (
+	id INTEGER PRIMARY KEY,
+	user_id BIGINT NOT NULL,
+	transaction_id VARCHAR(255),
+	delta NUMERIC(12, 2) NOT NULL,
+	balance NUMERIC(12, 2) NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	attempts INTEGER NOT NULL,
+	last_error TEXT,
+	failed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
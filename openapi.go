@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// openAPI is the parsed specification, the subset of OpenAPI 3 the request
+// validator understands
+var openAPI = mustParseOpenAPI(openAPISpec)
+
+type openAPIDocument struct {
+	Paths      map[string]map[string]openAPIOperation `json:"paths"`
+	Components struct {
+		Schemas map[string]*jsonSchema `json:"schemas"`
+	} `json:"components"`
+}
+
+type openAPIOperation struct {
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema *jsonSchema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+// jsonSchema holds the schema keywords checked on request bodies
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 string                 `json:"type"`
+	Format               string                 `json:"format"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []string               `json:"enum"`
+	MinLength            int                    `json:"minLength"`
+	// ErrorCode replaces the generic code of a missing, empty or out of enum
+	// value with the one the service answers for it, so a request gets the
+	// same code whichever check refuses it first
+	ErrorCode string `json:"x-error-code"`
+}
+
+// code is the error code of a failed value check on s
+func (s *jsonSchema) code(generic string) string {
+	if s.ErrorCode != "" {
+		return s.ErrorCode
+	}
+	return generic
+}
+
+func mustParseOpenAPI(spec []byte) *openAPIDocument {
+	var doc openAPIDocument
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		panic(fmt.Sprintf("invalid embedded openapi.json: %v", err))
+	}
+	return &doc
+}
+
+// schema resolves a local #/components/schemas reference
+func (d *openAPIDocument) schema(s *jsonSchema) *jsonSchema {
+	if name, ok := strings.CutPrefix(s.Ref, "#/components/schemas/"); ok {
+		return d.Components.Schemas[name]
+	}
+	return s
+}
+
+// bodySchema returns the JSON body schema of an operation, nil when it takes none
+func (d *openAPIDocument) bodySchema(path, method string) *jsonSchema {
+	op, ok := d.Paths[path][strings.ToLower(method)]
+	if !ok || op.RequestBody == nil {
+		return nil
+	}
+	content, ok := op.RequestBody.Content["application/json"]
+	if !ok || content.Schema == nil {
+		return nil
+	}
+	return d.schema(content.Schema)
+}
+
+// validate checks v, decoded with UseNumber, against s. path locates v in
+// the body for the error message.
+func (d *openAPIDocument) validate(s *jsonSchema, path string, v any) *ValidationError {
+	s = d.schema(s)
+	name := path
+	if name == "" {
+		name = "body"
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return invalid(name, "invalid_type", name+" must be an object")
+		}
+		for _, key := range s.Required {
+			if _, ok := obj[key]; !ok {
+				code := "missing_field"
+				if prop, ok := s.Properties[key]; ok {
+					code = d.schema(prop).code(code)
+				}
+				return invalid(joinPath(path, key), code, joinPath(path, key)+" is required")
+			}
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			prop, ok := s.Properties[key]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return invalid(joinPath(path, key), "unknown_field", "unknown field "+joinPath(path, key))
+				}
+				continue
+			}
+			if verr := d.validate(prop, joinPath(path, key), obj[key]); verr != nil {
+				return verr
+			}
+		}
+	case "array":
+		items, ok := v.([]any)
+		if !ok {
+			return invalid(name, "invalid_type", name+" must be an array")
+		}
+		for i, item := range items {
+			if verr := d.validate(s.Items, fmt.Sprintf("%s[%d]", name, i), item); verr != nil {
+				return verr
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return invalid(name, "invalid_type", name+" must be a string")
+		}
+		if len(str) < s.MinLength {
+			return invalid(name, s.code("empty_field"), name+" must not be empty")
+		}
+		if len(s.Enum) > 0 && !contains(s.Enum, str) {
+			return invalid(name, s.code("invalid_value"), name+" must be one of "+strings.Join(s.Enum, ", "))
+		}
+	case "integer":
+		n, ok := v.(json.Number)
+		if _, err := n.Int64(); !ok || err != nil {
+			return invalid(name, "invalid_type", name+" must be an integer")
+		}
+	case "number":
+		if _, ok := v.(json.Number); !ok {
+			return invalid(name, "invalid_type", name+" must be a number")
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return invalid(name, "invalid_type", name+" must be a boolean")
+		}
+	}
+	return nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleOpenAPI serves the OpenAPI document of the API version of the route
+func (s *APIServer) HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(versionOf(r).document)
+}
+
+// RequestValidationMiddleware checks JSON bodies against the schema of their
+// route in the OpenAPI document of its API version, so handlers only see
+// well-formed payloads.
+// Bodies must be sent as application/json and are bounded to maxBodySize.
+func RequestValidationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		version := versionOf(r)
+		if version.spec == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// the document's paths are relative to the version prefix
+		schema := version.spec.bodySchema(strings.TrimPrefix(tpl, version.prefix), r.Method)
+		if schema == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if verr := limitJSONBody(w, r); verr != nil {
+			writeValidationError(w, verr)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeValidationError(w, bodyError(err))
+			return
+		}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			writeValidationError(w, bodyError(err))
+			return
+		}
+		if verr := version.spec.validate(schema, "", v); verr != nil {
+			w.Header().Set(errorCodeHeader, verr.Code)
+			http.Error(w, "Invalid request body: "+verr.Message, http.StatusBadRequest)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestOpenAPI_SchemasMatchTypes fails when a payload type and its schema drift apart
+func TestOpenAPI_SchemasMatchTypes(t *testing.T) {
+	types := map[string]reflect.Type{
+		"TransactionRequest":         reflect.TypeOf(TransactionRequest{}),
+		"BalanceResponse":            reflect.TypeOf(BalanceResponse{}),
+		"TransactionResponse":        reflect.TypeOf(TransactionResponse{}),
+		"TransactionHistoryResponse": reflect.TypeOf(TransactionHistoryResponse{}),
+		"ReversalResponse":           reflect.TypeOf(ReversalResponse{}),
+	}
+	for name, typ := range types {
+		t.Run(name, func(t *testing.T) {
+			schema := openAPI.Components.Schemas[name]
+			require.NotNil(t, schema, "missing from components.schemas")
+			assert.Equal(t, "object", schema.Type)
+
+			var fields []string
+			for i := 0; i < typ.NumField(); i++ {
+				f := typ.Field(i)
+				tag, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+				fields = append(fields, tag)
+
+				prop := schema.Properties[tag]
+				if !assert.NotNil(t, prop, "field %s is not in the schema", tag) {
+					continue
+				}
+				assert.Equal(t, schemaType(f.Type), openAPI.schema(prop).Type, "type of %s", tag)
+				if !strings.Contains(opts, "omitempty") {
+					assert.Contains(t, schema.Required, tag, "%s is always present", tag)
+				}
+			}
+
+			var props []string
+			for prop := range schema.Properties {
+				props = append(props, prop)
+			}
+			sort.Strings(fields)
+			sort.Strings(props)
+			assert.Equal(t, fields, props)
+		})
+	}
+}
+
+func schemaType(t reflect.Type) string {
+	if t == reflect.TypeOf(time.Time{}) {
+		return "string"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func TestOpenAPI_PathsAreRouted(t *testing.T) {
+	router := NewAPIServer(NewMockStore()).Router()
+	for path, ops := range openAPI.Paths {
+		for method := range ops {
+			url := path
+			for _, param := range []string{"{userId}", "{transactionId}"} {
+				url = strings.ReplaceAll(url, param, "1")
+			}
+			// paths are relative to the /v1 server, and still served without it
+			for _, prefix := range []string{apiV1.prefix, ""} {
+				req := httptest.NewRequest(strings.ToUpper(method), prefix+url, nil)
+				var match mux.RouteMatch
+				if assert.True(t, router.Match(req, &match), "%s %s%s", method, prefix, path) {
+					tpl, _ := match.Route.GetPathTemplate()
+					assert.Equal(t, prefix+path, tpl)
+				}
+			}
+		}
+	}
+}
+
+func TestHandleOpenAPI(t *testing.T) {
+	router := NewAPIServer(NewMockStore()).Router()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/openapi.json", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	var doc map[string]any
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &doc))
+	assert.Equal(t, "3.0.3", doc["openapi"])
+}
+
+func TestRequestValidationMiddleware(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		code int
+		msg  string
+	}{
+		{"valid", `{"state":"win","amount":"1.00","transactionId":"val-1"}`, http.StatusOK, "success"},
+		{"unknown field", `{"state":"win","amount":"1.00","transactionId":"val-2","currency":"EUR"}`, http.StatusBadRequest, "Invalid request body: unknown field currency"},
+		{"amount as number", `{"state":"win","amount":1,"transactionId":"val-3"}`, http.StatusBadRequest, "Invalid request body: amount must be a string"},
+		{"missing transactionId", `{"state":"win","amount":"1.00"}`, http.StatusBadRequest, "Invalid request body: transactionId is required"},
+		{"empty transactionId", `{"state":"win","amount":"1.00","transactionId":""}`, http.StatusBadRequest, "Invalid request body: transactionId must not be empty"},
+		{"unknown state", `{"state":"draw","amount":"1.00","transactionId":"val-4"}`, http.StatusBadRequest, "Invalid request body: state must be one of win, lose"},
+		{"not an object", `["win"]`, http.StatusBadRequest, "Invalid request body: body must be an object"},
+		{"malformed", `{"state":`, http.StatusBadRequest, "Invalid JSON body"},
+	}
+	router := NewAPIServer(NewMockStore()).Router()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/user/1/transaction", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Source-Type", "game")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.code, rr.Code)
+			assert.Contains(t, rr.Body.String(), tt.msg)
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// outboxLockID is the advisory lock key that lets one relay publish at a time
+const outboxLockID int64 = 0x6f7574626f78 // "outbox"
+
+// EventBalanceChanged is the type of the events written by balance mutations
+const EventBalanceChanged = "balance.changed"
+
+// BalanceEvent is published for every balance change. Delivery is at least
+// once, consumers should deduplicate on ID.
+type BalanceEvent struct {
+	ID            int64     `json:"id"`
+	Type          string    `json:"type"`
+	UserID        uint64    `json:"userId"`
+	TransactionID string    `json:"transactionId,omitempty"`
+	Delta         string    `json:"delta"`
+	Balance       string    `json:"balance"`
+	OccurredAt    time.Time `json:"occurredAt"`
+}
+
+// insertOutboxEvent records a balance change inside the mutation's transaction
+func insertOutboxEvent(ctx context.Context, tx *sql.Tx, userID uint64, t *Transaction, delta, balance float64) error {
+	var transactionID sql.NullString
+	if t != nil {
+		transactionID = sql.NullString{String: t.TransactionID, Valid: true}
+	}
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO outbox (user_id, transaction_id, delta, balance) VALUES ($1, $2, $3, $4)",
+		userID, transactionID, delta, balance)
+	return err
+}
+
+// Publisher delivers balance events to downstream systems
+type Publisher interface {
+	Publish(ctx context.Context, event BalanceEvent) error
+}
+
+// WriterPublisher writes one JSON document per event, for local use
+type WriterPublisher struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+}
+
+func NewWriterPublisher(w io.Writer) *WriterPublisher {
+	return &WriterPublisher{enc: json.NewEncoder(w)}
+}
+
+// NewFilePublisher appends events to the file at path
+func NewFilePublisher(path string) (*WriterPublisher, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	publisher := NewWriterPublisher(f)
+	publisher.closer = f
+	return publisher, nil
+}
+
+func (p *WriterPublisher) Publish(ctx context.Context, event BalanceEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.enc.Encode(event)
+}
+
+func (p *WriterPublisher) Close() error {
+	if p.closer == nil {
+		return nil
+	}
+	return p.closer.Close()
+}
+
+// WebhookPublisher POSTs each event as JSON to URL, any 2xx answer counts as delivered
+type WebhookPublisher struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewWebhookPublisher(url string) *WebhookPublisher {
+	return &WebhookPublisher{
+		URL:    url,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *WebhookPublisher) Publish(ctx context.Context, event BalanceEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Event-Id", strconv.FormatInt(event.ID, 10))
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// newPublisher builds the publisher selected by name: none, stdout, file or webhook
+func newPublisher(name, path, url string) (Publisher, error) {
+	switch name {
+	case "", "none":
+		return nil, nil
+	case "stdout":
+		return NewWriterPublisher(os.Stdout), nil
+	case "file":
+		return NewFilePublisher(path)
+	case "webhook":
+		if url == "" {
+			return nil, fmt.Errorf("the webhook publisher needs a URL")
+		}
+		return NewWebhookPublisher(url), nil
+	default:
+		return nil, fmt.Errorf("unknown outbox publisher %q", name)
+	}
+}
+
+// multiPublisher hands every event to each of its publishers in turn. A
+// failure makes the relay retry all of them, which at-least-once allows.
+type multiPublisher []Publisher
+
+func (m multiPublisher) Publish(ctx context.Context, event BalanceEvent) error {
+	for _, p := range m {
+		if err := p.Publish(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OutboxConfig tunes how the relay polls and retries
+type OutboxConfig struct {
+	PollInterval   time.Duration
+	BatchSize      int
+	PublishTimeout time.Duration
+	// MaxAttempts moves an event to outbox_dead_letter after that many failures
+	MaxAttempts int
+	Retry       RetryPolicy
+}
+
+func DefaultOutboxConfig() OutboxConfig {
+	return OutboxConfig{
+		PollInterval:   time.Second,
+		BatchSize:      100,
+		PublishTimeout: 10 * time.Second,
+		MaxAttempts:    10,
+		Retry:          RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Minute},
+	}
+}
+
+// OutboxRelay publishes the events of the outbox table and deletes them once
+// delivered. Only the oldest pending event of each user is picked up, so a
+// user's events are delivered in order and a failing one holds back the
+// following ones until it succeeds or is dead-lettered.
+type OutboxRelay struct {
+	db        *sql.DB
+	publisher Publisher
+	cfg       OutboxConfig
+}
+
+func NewOutboxRelay(db *sql.DB, publisher Publisher, cfg OutboxConfig) *OutboxRelay {
+	return &OutboxRelay{
+		db:        db,
+		publisher: publisher,
+		cfg:       cfg,
+	}
+}
+
+// Run relays events until ctx is done, polling when the outbox is drained
+func (r *OutboxRelay) Run(ctx context.Context) {
+	for {
+		delivered, err := r.RelayOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "outbox relay failed", "error", err)
+		}
+		if delivered > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.cfg.PollInterval):
+		}
+	}
+}
+
+// pendingOutboxQuery picks the head of each user's queue that is due
+const pendingOutboxQuery = `
+	SELECT id, user_id, transaction_id, delta, balance, created_at, attempts FROM (
+		SELECT DISTINCT ON (user_id) id, user_id, transaction_id, delta, balance, created_at, attempts, next_attempt_at
+		FROM outbox ORDER BY user_id, id
+	) heads
+	WHERE next_attempt_at <= NOW()
+	ORDER BY id
+	LIMIT $1`
+
+// RelayOnce publishes one batch and returns how many events were delivered.
+// It does nothing while another relay holds the outbox lock.
+func (r *OutboxRelay) RelayOnce(ctx context.Context) (int, error) {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", outboxLockID).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, nil
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", outboxLockID)
+
+	events, attempts, err := r.pending(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for i, event := range events {
+		pubCtx, cancel := context.WithTimeout(ctx, r.cfg.PublishTimeout)
+		err := r.publisher.Publish(pubCtx, event)
+		cancel()
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return delivered, ctx.Err()
+			}
+			if err := r.fail(ctx, conn, event, attempts[i]+1, err); err != nil {
+				return delivered, err
+			}
+			continue
+		}
+		if _, err := conn.ExecContext(ctx, "DELETE FROM outbox WHERE id = $1", event.ID); err != nil {
+			return delivered, err
+		}
+		delivered++
+	}
+	return delivered, nil
+}
+
+func (r *OutboxRelay) pending(ctx context.Context, conn *sql.Conn) ([]BalanceEvent, []int, error) {
+	rows, err := conn.QueryContext(ctx, pendingOutboxQuery, r.cfg.BatchSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var events []BalanceEvent
+	var attempts []int
+	for rows.Next() {
+		var event BalanceEvent
+		var transactionID sql.NullString
+		var delta, balance float64
+		var n int
+		if err := rows.Scan(&event.ID, &event.UserID, &transactionID, &delta, &balance, &event.OccurredAt, &n); err != nil {
+			return nil, nil, err
+		}
+		event.Type = EventBalanceChanged
+		event.TransactionID = transactionID.String
+		event.Delta = formatAmount(delta)
+		event.Balance = formatAmount(balance)
+		events = append(events, event)
+		attempts = append(attempts, n)
+	}
+	return events, attempts, rows.Err()
+}
+
+// fail schedules the event for another attempt, or dead-letters it once it
+// has failed MaxAttempts times
+func (r *OutboxRelay) fail(ctx context.Context, conn *sql.Conn, event BalanceEvent, attempts int, cause error) error {
+	if attempts < r.cfg.MaxAttempts {
+		delay := r.cfg.Retry.Backoff(attempts)
+		slog.WarnContext(ctx, "outbox event not delivered, will retry",
+			"event_id", event.ID, "user_id", event.UserID, "attempt", attempts, "delay_ms", delay.Milliseconds(), "error", cause)
+		_, err := conn.ExecContext(ctx, `
+			UPDATE outbox SET attempts = $2, last_error = $3, next_attempt_at = NOW() + $4::float8 * INTERVAL '1 millisecond'
+			WHERE id = $1`, event.ID, attempts, cause.Error(), delay.Milliseconds())
+		return err
+	}
+
+	slog.ErrorContext(ctx, "outbox event moved to dead letter table",
+		"event_id", event.ID, "user_id", event.UserID, "attempts", attempts, "error", cause)
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO outbox_dead_letter (id, user_id, transaction_id, delta, balance, created_at, attempts, last_error)
+		SELECT id, user_id, transaction_id, delta, balance, created_at, $2, $3 FROM outbox WHERE id = $1`,
+		event.ID, attempts, cause.Error())
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM outbox WHERE id = $1", event.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingPublisher keeps published events and fails while err is set
+type recordingPublisher struct {
+	events []BalanceEvent
+	err    error
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, event BalanceEvent) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.events = append(p.events, event)
+	return nil
+}
+
+func TestApplyTransaction_WritesOutboxEvent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	store := &PostgresStore{Db: db, outbox: true}
+	tx := Transaction{TransactionID: "txn-evt", UserID: 1, State: "win", Amount: 10.0, SourceType: "game", CreatedAt: time.Now()}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT balance FROM users WHERE user_id = \\$1 FOR UPDATE").
+		WithArgs(tx.UserID).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(50.0))
+	mock.ExpectExec("INSERT INTO transactions").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("UPDATE users SET balance").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO outbox \\(user_id, transaction_id, delta, balance\\)").
+		WithArgs(tx.UserID, "txn-evt", 10.0, 60.0).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, store.ApplyTransaction(context.Background(), tx, 10.0))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestConditionalQuery_Outbox(t *testing.T) {
+	assert.NotContains(t, conditionalQuery(true, false, false), "INSERT INTO outbox")
+	assert.Contains(t, conditionalQuery(true, true, false), "SELECT $1, $3::varchar, $2, balance FROM upd")
+	assert.Contains(t, conditionalQuery(false, true, false), "SELECT $1, NULL, $2, balance FROM upd")
+	assert.NotContains(t, conditionalQuery(false, true, false), "INSERT INTO transactions")
+}
+
+func expectOutboxLock(mock sqlmock.Sqlmock, acquired bool) {
+	mock.ExpectQuery("SELECT pg_try_advisory_lock\\(\\$1\\)").
+		WithArgs(outboxLockID).
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(acquired))
+}
+
+func expectPendingEvents(mock sqlmock.Sqlmock, attempts int) {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("SELECT DISTINCT ON \\(user_id\\)").
+		WithArgs(100).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "transaction_id", "delta", "balance", "created_at", "attempts"}).
+			AddRow(7, 1, "txn-1", 10.15, 60.15, created, attempts).
+			AddRow(8, 2, nil, -5.0, 0.0, created, 0))
+}
+
+func TestOutboxRelay_SkipsWithoutLock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	publisher := &recordingPublisher{}
+	expectOutboxLock(mock, false)
+
+	delivered, err := NewOutboxRelay(db, publisher, DefaultOutboxConfig()).RelayOnce(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+	assert.Empty(t, publisher.events)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOutboxRelay_PublishesAndDeletes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	publisher := &recordingPublisher{}
+	expectOutboxLock(mock, true)
+	expectPendingEvents(mock, 0)
+	mock.ExpectExec("DELETE FROM outbox WHERE id = \\$1").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM outbox WHERE id = \\$1").WithArgs(8).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("SELECT pg_advisory_unlock").WithArgs(outboxLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	delivered, err := NewOutboxRelay(db, publisher, DefaultOutboxConfig()).RelayOnce(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, delivered)
+	assert.Equal(t, []BalanceEvent{
+		{ID: 7, Type: EventBalanceChanged, UserID: 1, TransactionID: "txn-1", Delta: "10.15", Balance: "60.15", OccurredAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+		{ID: 8, Type: EventBalanceChanged, UserID: 2, Delta: "-5.00", Balance: "0.00", OccurredAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+	}, publisher.events)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOutboxRelay_ReschedulesFailedEvents(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	publisher := &recordingPublisher{err: errors.New("connection refused")}
+	expectOutboxLock(mock, true)
+	expectPendingEvents(mock, 0)
+	mock.ExpectExec("UPDATE outbox SET attempts = \\$2, last_error = \\$3").
+		WithArgs(7, 1, "connection refused", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE outbox SET attempts = \\$2, last_error = \\$3").
+		WithArgs(8, 1, "connection refused", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("SELECT pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	delivered, err := NewOutboxRelay(db, publisher, DefaultOutboxConfig()).RelayOnce(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOutboxRelay_DeadLettersAfterMaxAttempts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	publisher := &recordingPublisher{err: errors.New("webhook answered 500 Internal Server Error")}
+	cfg := DefaultOutboxConfig()
+	cfg.MaxAttempts = 3
+
+	expectOutboxLock(mock, true)
+	expectPendingEvents(mock, 2)
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO outbox_dead_letter").
+		WithArgs(7, 3, "webhook answered 500 Internal Server Error").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM outbox WHERE id = \\$1").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("UPDATE outbox SET attempts").
+		WithArgs(8, 1, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("SELECT pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	_, err = NewOutboxRelay(db, publisher, cfg).RelayOnce(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	var got BalanceEvent
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "7", r.Header.Get("Event-Id"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	publisher := NewWebhookPublisher(srv.URL)
+	event := BalanceEvent{ID: 7, Type: EventBalanceChanged, UserID: 1, Delta: "1.00", Balance: "1.00"}
+
+	assert.NoError(t, publisher.Publish(context.Background(), event))
+	assert.Equal(t, event.UserID, got.UserID)
+
+	status = http.StatusBadGateway
+	assert.ErrorContains(t, publisher.Publish(context.Background(), event), "502")
+}
+
+func TestNewPublisher(t *testing.T) {
+	p, err := newPublisher("none", "", "")
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+
+	_, err = newPublisher("webhook", "", "")
+	assert.Error(t, err)
+
+	_, err = newPublisher("kafka", "", "")
+	assert.ErrorContains(t, err, `unknown outbox publisher "kafka"`)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// defaultUserQueueDepth is how many transactions of one user may be in flight
+// or waiting before new ones are turned away
+const defaultUserQueueDepth = 32
+
+// errQueueFull is returned when a user already has too many transactions queued
+var errQueueFull = errors.New("too many transactions in progress for this user")
+
+// userQueue serializes transactions per user inside the process, so a burst
+// for one user holds at most one database connection and waits here instead
+// of on a row lock, leaving the pool to other users. Requests carrying the
+// same transaction ID while one is in flight share its result.
+type userQueue struct {
+	maxDepth int
+
+	mu      sync.Mutex
+	lanes   map[uint64]*userLane
+	flights map[string]*flight
+}
+
+// userLane is the queue of one user, turn is held by the running transaction
+type userLane struct {
+	depth int
+	turn  chan struct{}
+}
+
+// flight is the run of one transaction ID, shared by the requests carrying it.
+// It runs on a context detached from its callers, cancelled once the last of
+// them gives up waiting.
+type flight struct {
+	done   chan struct{}
+	err    error
+	cancel context.CancelFunc
+
+	// waiters counts the requests still waiting for the result, guarded by userQueue.mu
+	waiters int
+}
+
+func newUserQueue(maxDepth int) *userQueue {
+	return &userQueue{
+		maxDepth: maxDepth,
+		lanes:    make(map[uint64]*userLane),
+		flights:  make(map[string]*flight),
+	}
+}
+
+// Do runs fn once it is userID's turn and returns its error. When a
+// transaction with the same ID is already in flight, Do waits for it instead
+// and reports shared; fn is not run. fn gets a context that a caller giving up
+// doesn't cancel, so every caller sharing the flight gets the transaction's
+// result; it is cancelled when no caller waits anymore. A nil queue runs fn
+// right away on ctx.
+func (q *userQueue) Do(ctx context.Context, userID uint64, transactionID string, fn func(ctx context.Context) error) (shared bool, err error) {
+	if q == nil {
+		return false, fn(ctx)
+	}
+
+	q.mu.Lock()
+	if f, ok := q.flights[transactionID]; ok {
+		f.waiters++
+		q.mu.Unlock()
+		return true, q.wait(ctx, transactionID, f)
+	}
+
+	lane, ok := q.lanes[userID]
+	if !ok {
+		lane = &userLane{turn: make(chan struct{}, 1)}
+		q.lanes[userID] = lane
+	}
+	if lane.depth >= q.maxDepth {
+		q.mu.Unlock()
+		return false, errQueueFull
+	}
+	lane.depth++
+	workCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	f := &flight{done: make(chan struct{}), cancel: cancel, waiters: 1}
+	q.flights[transactionID] = f
+	q.mu.Unlock()
+
+	go q.run(workCtx, userID, transactionID, lane, f, fn)
+	return false, q.wait(ctx, transactionID, f)
+}
+
+// run waits for the lane's turn and runs fn for the flight
+func (q *userQueue) run(ctx context.Context, userID uint64, transactionID string, lane *userLane, f *flight, fn func(ctx context.Context) error) {
+	defer func() {
+		q.mu.Lock()
+		if q.flights[transactionID] == f {
+			delete(q.flights, transactionID)
+		}
+		lane.depth--
+		if lane.depth == 0 {
+			delete(q.lanes, userID)
+		}
+		q.mu.Unlock()
+		f.cancel()
+		close(f.done)
+	}()
+
+	select {
+	case lane.turn <- struct{}{}:
+	case <-ctx.Done():
+		f.err = ctx.Err()
+		return
+	}
+	defer func() { <-lane.turn }()
+	f.err = fn(ctx)
+}
+
+// wait returns the flight's result, or ctx's error when the caller gives up
+// first. The last caller to give up cancels the flight, a later request with
+// the same ID starts a new one.
+func (q *userQueue) wait(ctx context.Context, transactionID string, f *flight) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	f.waiters--
+	if f.waiters == 0 {
+		if q.flights[transactionID] == f {
+			delete(q.flights, transactionID)
+		}
+		f.cancel()
+	}
+	q.mu.Unlock()
+	return ctx.Err()
+}
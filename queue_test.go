@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserQueue_SerializesPerUser(t *testing.T) {
+	q := newUserQueue(100)
+	var running, maxRunning atomic.Int32
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := q.Do(context.Background(), 1, fmt.Sprintf("txn-%d", i), func(ctx context.Context) error {
+				n := running.Add(1)
+				for {
+					m := maxRunning.Load()
+					if n <= m || maxRunning.CompareAndSwap(m, n) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				running.Add(-1)
+				return nil
+			})
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), maxRunning.Load())
+	assert.Empty(t, q.lanes, "idle lanes must be released")
+	assert.Empty(t, q.flights)
+}
+
+func TestUserQueue_OtherUsersDoNotWait(t *testing.T) {
+	q := newUserQueue(10)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go q.Do(context.Background(), 1, "txn-slow", func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := q.Do(ctx, 2, "txn-other", func(ctx context.Context) error { return nil })
+	assert.NoError(t, err)
+	close(release)
+}
+
+func TestUserQueue_CoalescesSameTransaction(t *testing.T) {
+	q := newUserQueue(10)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	leaderErr := errors.New("balance cannot be negative")
+
+	go q.Do(context.Background(), 1, "txn-dup", func(ctx context.Context) error {
+		close(started)
+		<-release
+		return leaderErr
+	})
+	<-started
+
+	result := make(chan error)
+	go func() {
+		shared, err := q.Do(context.Background(), 1, "txn-dup", func(ctx context.Context) error {
+			t.Error("a coalesced request must not run")
+			return nil
+		})
+		assert.True(t, shared)
+		result <- err
+	}()
+
+	assert.Eventually(t, func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		// the leader and the coalesced request
+		return q.flights["txn-dup"].waiters == 2
+	}, time.Second, time.Millisecond)
+	close(release)
+	assert.Equal(t, leaderErr, <-result)
+}
+
+func TestUserQueue_LeaderGivingUpDoesNotFailWaiters(t *testing.T) {
+	q := newUserQueue(10)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leader := make(chan error)
+	go func() {
+		_, err := q.Do(leaderCtx, 1, "txn-shared", func(ctx context.Context) error {
+			close(started)
+			<-release
+			return ctx.Err()
+		})
+		leader <- err
+	}()
+	<-started
+
+	waiter := make(chan error)
+	go func() {
+		_, err := q.Do(context.Background(), 1, "txn-shared", func(ctx context.Context) error { return nil })
+		waiter <- err
+	}()
+	assert.Eventually(t, func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return q.flights["txn-shared"].waiters == 2
+	}, time.Second, time.Millisecond)
+
+	// the leader's client disconnects, the transaction goes on for the waiter
+	cancelLeader()
+	assert.ErrorIs(t, <-leader, context.Canceled)
+	close(release)
+	assert.NoError(t, <-waiter)
+}
+
+func TestUserQueue_RejectsWhenFull(t *testing.T) {
+	q := newUserQueue(1)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go q.Do(context.Background(), 1, "txn-1", func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	_, err := q.Do(context.Background(), 1, "txn-2", func(ctx context.Context) error { return nil })
+	assert.ErrorIs(t, err, errQueueFull)
+	close(release)
+}
+
+func TestUserQueue_GivesUpWaitingOnDeadline(t *testing.T) {
+	q := newUserQueue(10)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go q.Do(context.Background(), 1, "txn-1", func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := q.Do(ctx, 1, "txn-2", func(ctx context.Context) error { return nil })
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	close(release)
+}
+
+// gatedStore holds ApplyTransaction until the test releases it
+type gatedStore struct {
+	*MemoryStore
+	started chan struct{}
+	release chan struct{}
+	calls   *atomic.Int32
+}
+
+func (g gatedStore) ApplyTransaction(ctx context.Context, tx Transaction, delta float64) error {
+	g.calls.Add(1)
+	g.started <- struct{}{}
+	<-g.release
+	return g.MemoryStore.ApplyTransaction(ctx, tx, delta)
+}
+
+func TestHandleTransaction_QueueFullAndCoalescing(t *testing.T) {
+	store := gatedStore{NewMemoryStore(), make(chan struct{}, 10), make(chan struct{}), &atomic.Int32{}}
+	assert.NoError(t, store.Init(context.Background()))
+	router := NewAPIServer(store, WithUserQueueDepth(1)).Router()
+
+	send := func(txID string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(TransactionRequest{State: "win", Amount: "1.00", TransactionID: txID})
+		req := httptest.NewRequest("POST", "/user/1/transaction", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Source-Type", "game")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- send("txn-a") }()
+	<-store.started
+
+	// the same transaction waits for the one in flight
+	dup := make(chan *httptest.ResponseRecorder)
+	go func() { dup <- send("txn-a") }()
+
+	// another transaction of the same user doesn't fit in the queue
+	full := send("txn-b")
+	assert.Equal(t, http.StatusTooManyRequests, full.Code)
+	assert.Equal(t, "1", full.Header().Get("Retry-After"))
+
+	close(store.release)
+	assert.Equal(t, http.StatusOK, (<-first).Code)
+	rr := <-dup
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "already processed")
+	assert.Equal(t, int32(1), store.calls.Load())
+}
+
+func TestHandleTransaction_CoalescedRejectionCountedOnce(t *testing.T) {
+	store := gatedStore{NewMemoryStore(), make(chan struct{}, 10), make(chan struct{}), &atomic.Int32{}}
+	assert.NoError(t, store.Init(context.Background()))
+	server := NewAPIServer(store)
+	router := server.Router()
+
+	send := func() *httptest.ResponseRecorder {
+		body, _ := json.Marshal(TransactionRequest{State: "lose", Amount: "1000.00", TransactionID: "txn-broke"})
+		req := httptest.NewRequest("POST", "/user/1/transaction", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Source-Type", "game")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- send() }()
+	<-store.started
+	dup := make(chan *httptest.ResponseRecorder)
+	go func() { dup <- send() }()
+	q := server.service.queue
+	assert.Eventually(t, func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return q.flights["txn-broke"].waiters == 2
+	}, time.Second, time.Millisecond)
+	close(store.release)
+
+	assert.Equal(t, http.StatusBadRequest, (<-first).Code)
+	assert.Equal(t, http.StatusBadRequest, (<-dup).Code)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, rr.Body.String(), `balance_insufficient_funds_total{source_type="game"} 1`+"\n")
+}
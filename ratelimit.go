@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned by Storage.ConsumeQuota when a transaction
+// would take its source over a daily quota
+var ErrQuotaExceeded = errors.New("daily quota exceeded")
+
+// LimitError refuses a transaction over a rate limit or a daily quota. Code
+// names the limit, RetryAfter is when the client may expect to be served.
+type LimitError struct {
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return e.Message
+}
+
+// RateLimitConfig bounds how fast transactions are accepted, with token
+// buckets refilled at Rate per second and holding up to Burst transactions.
+// A Rate of 0 disables that limit.
+type RateLimitConfig struct {
+	// SourceRate and SourceBurst apply to each Source-Type, unless Sources
+	// sets a rate for it, which comes with a burst of one second's worth
+	SourceRate  float64
+	SourceBurst int
+	Sources     map[string]float64
+
+	// UserRate and UserBurst apply to each user
+	UserRate  float64
+	UserBurst int
+}
+
+// QuotaConfig bounds what each Source-Type may send per UTC day, persisted by
+// the store so restarts don't reset it. 0 disables a quota.
+type QuotaConfig struct {
+	DailyCount  int64
+	DailyAmount float64
+}
+
+func (q QuotaConfig) enabled() bool {
+	return q.DailyCount > 0 || q.DailyAmount > 0
+}
+
+// parseSourceRates reads source=rate pairs separated by commas, e.g. "payment=5,game=200"
+func parseSourceRates(spec string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		source, value, ok := strings.Cut(pair, "=")
+		source = strings.TrimSpace(source)
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if !ok || source == "" || err != nil || rate < 0 {
+			return nil, fmt.Errorf("invalid source rate %q, expected source=rate", pair)
+		}
+		rates[source] = rate
+	}
+	return rates, nil
+}
+
+// rateLimiter keeps one token bucket per key, created full on first use. rate
+// and burst apply to the keys allowed without their own.
+type rateLimiter struct {
+	rate  float64
+	burst int
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket is refilled at rate tokens per second up to capacity
+type tokenBucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+// limiterSweepSize is the bucket count above which refilled buckets are
+// dropped, a full bucket behaves like a missing one
+const limiterSweepSize = 10000
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   burst,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// bucketCapacity is burst, or one second's worth of rate when burst isn't set
+func bucketCapacity(rate float64, burst int) float64 {
+	if burst < 1 {
+		return math.Max(1, math.Ceil(rate))
+	}
+	return float64(burst)
+}
+
+// allow takes a token for key, or tells how long until one is available
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	return l.allowRate(key, l.rate, l.burst)
+}
+
+// allowRate is allow with the rate and burst of key overridden
+func (l *rateLimiter) allowRate(key string, rate float64, burst int) (bool, time.Duration) {
+	now := l.now()
+	capacity := bucketCapacity(rate, burst)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.buckets) >= limiterSweepSize {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+	b.rate, b.capacity = rate, capacity
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.capacity {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// limits enforces the rate limits and daily quotas on transactions
+type limits struct {
+	sources     *rateLimiter
+	sourceRates map[string]float64
+	users       *rateLimiter
+	quota       QuotaConfig
+}
+
+// newLimits returns nil when neither a rate limit nor a quota is set
+func newLimits(rates RateLimitConfig, quota QuotaConfig) *limits {
+	if rates.SourceRate <= 0 && len(rates.Sources) == 0 && rates.UserRate <= 0 && !quota.enabled() {
+		return nil
+	}
+	l := &limits{sourceRates: rates.Sources, quota: quota}
+	if rates.SourceRate > 0 || len(rates.Sources) > 0 {
+		l.sources = newRateLimiter(rates.SourceRate, rates.SourceBurst)
+	}
+	if rates.UserRate > 0 {
+		l.users = newRateLimiter(rates.UserRate, rates.UserBurst)
+	}
+	return l
+}
+
+// allow applies the rate limits of the transaction's source and user. A nil
+// limits allows everything.
+func (l *limits) allow(tx Transaction) *LimitError {
+	if l == nil {
+		return nil
+	}
+	if l.sources != nil {
+		rate, burst := l.sources.rate, l.sources.burst
+		if r, ok := l.sourceRates[tx.SourceType]; ok {
+			rate, burst = r, 0
+		}
+		if rate > 0 {
+			if ok, wait := l.sources.allowRate(tx.SourceType, rate, burst); !ok {
+				return &LimitError{Code: "source_rate_limited", Message: "Too many transactions from this source", RetryAfter: wait}
+			}
+		}
+	}
+	if l.users != nil {
+		if ok, wait := l.users.allow(strconv.FormatUint(tx.UserID, 10)); !ok {
+			return &LimitError{Code: "user_rate_limited", Message: "Too many transactions for this user", RetryAfter: wait}
+		}
+	}
+	return nil
+}
+
+// quotaExceeded is the LimitError of a source over its daily quota, which
+// resets at the next UTC midnight
+func quotaExceeded(now time.Time) *LimitError {
+	day := now.UTC().Truncate(24 * time.Hour)
+	return &LimitError{
+		Code:       "daily_quota_exceeded",
+		Message:    "Daily quota of this source exceeded",
+		RetryAfter: day.Add(24 * time.Hour).Sub(now),
+	}
+}
+
+// consumeQuota counts tx against the daily quota of its source. The returned
+// release gives the quota back when the transaction is known not to be
+// applied, see notApplied.
+func (b *BalanceService) consumeQuota(ctx context.Context, tx Transaction) (release func(), err error) {
+	if b.limits == nil || !b.limits.quota.enabled() {
+		return func() {}, nil
+	}
+	day := tx.CreatedAt.UTC()
+	err = b.traceStore(ctx, "ConsumeQuota", func(ctx context.Context) error {
+		return b.store.ConsumeQuota(ctx, tx.SourceType, day, tx.Amount, b.limits.quota)
+	})
+	if errors.Is(err, ErrQuotaExceeded) {
+		return nil, quotaExceeded(tx.CreatedAt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		// the request context may be done already, the quota must be given back anyway
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), defaultRequestTimeout)
+		defer cancel()
+		err := b.traceStore(ctx, "ReleaseQuota", func(ctx context.Context) error {
+			return b.store.ReleaseQuota(ctx, tx.SourceType, day, tx.Amount)
+		})
+		if err != nil {
+			b.logger.ErrorContext(ctx, "failed to release quota", "source_type", tx.SourceType, "error", err)
+		}
+	}, nil
+}
+
+// notApplied reports whether err proves a transaction wasn't recorded, so
+// its quota can be given back. A timeout or an unknown store error may hide
+// a commit and keeps the quota.
+func notApplied(err error) bool {
+	return isValidationError(err) || errors.Is(err, ErrInsufficientFunds) ||
+		errors.Is(err, ErrUserNotFound) || errors.Is(err, errQueueFull) || errors.Is(err, ErrConcurrentUpdate)
+}
+
+// quotaExceededBy reports whether a day's usage after adding one transaction
+// of amountCents would be over q, shared by the stores
+func quotaExceededBy(q QuotaConfig, count, amountCents int64) bool {
+	return (q.DailyCount > 0 && count > q.DailyCount) ||
+		(q.DailyAmount > 0 && amountCents > amountToCents(q.DailyAmount))
+}
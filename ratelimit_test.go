@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter_TokenBucket(t *testing.T) {
+	now := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow("game")
+		assert.True(t, ok, "the burst is available at once")
+	}
+	ok, wait := l.allow("game")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	ok, _ = l.allow("payment")
+	assert.True(t, ok, "keys have their own bucket")
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.allow("game")
+	assert.True(t, ok, "one token refilled")
+	ok, _ = l.allow("game")
+	assert.False(t, ok)
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow("game")
+		assert.True(t, ok, "refills stop at the burst")
+	}
+	ok, _ = l.allow("game")
+	assert.False(t, ok)
+}
+
+func TestLimits_SourceOverridesAndUsers(t *testing.T) {
+	l := newLimits(RateLimitConfig{SourceRate: 1, SourceBurst: 1, Sources: map[string]float64{"server": 0, "payment": 2}, UserRate: 1, UserBurst: 2}, QuotaConfig{})
+	require.NotNil(t, l)
+	tx := func(source string, userID uint64) Transaction {
+		return Transaction{SourceType: source, UserID: userID}
+	}
+
+	assert.Nil(t, l.allow(tx("game", 1)))
+	lerr := l.allow(tx("game", 2))
+	require.NotNil(t, lerr)
+	assert.Equal(t, "source_rate_limited", lerr.Code)
+
+	// 0 lifts the limit of server, the user limit still applies
+	assert.Nil(t, l.allow(tx("server", 3)))
+	assert.Nil(t, l.allow(tx("server", 3)))
+	lerr = l.allow(tx("server", 3))
+	require.NotNil(t, lerr)
+	assert.Equal(t, "user_rate_limited", lerr.Code)
+	assert.Positive(t, lerr.RetryAfter)
+
+	assert.Nil(t, newLimits(RateLimitConfig{}, QuotaConfig{}), "nothing configured")
+	assert.Nil(t, (*limits)(nil).allow(tx("game", 1)))
+}
+
+func TestLimits_SourceOverrideHasItsOwnBurst(t *testing.T) {
+	l := newLimits(RateLimitConfig{SourceRate: 1, SourceBurst: 1, Sources: map[string]float64{"payment": 3}}, QuotaConfig{})
+	now := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+	l.sources.now = func() time.Time { return now }
+	payment := Transaction{SourceType: "payment", UserID: 1}
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, l.allow(payment), "one second's worth of the source's own rate")
+	}
+	lerr := l.allow(payment)
+	require.NotNil(t, lerr)
+	assert.Equal(t, "source_rate_limited", lerr.Code)
+
+	assert.Nil(t, l.allow(Transaction{SourceType: "game", UserID: 1}))
+	assert.NotNil(t, l.allow(Transaction{SourceType: "game", UserID: 1}), "other sources keep SourceBurst")
+}
+
+func TestRateLimiter_SweepUsesBucketRate(t *testing.T) {
+	now := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(100, 0)
+	l.now = func() time.Time { return now }
+	l.allowRate("slow", 0.01, 1)
+	l.allow("fast")
+
+	l.sweep(now.Add(time.Second))
+	assert.Contains(t, l.buckets, "slow", "still refilling at its own rate")
+	assert.NotContains(t, l.buckets, "fast")
+
+	ok, _ := l.allowRate("slow", 0.01, 1)
+	assert.False(t, ok)
+}
+
+func TestBalanceService_ReplaysAreNotRateLimited(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newTestService(t)
+	svc.limits = newLimits(RateLimitConfig{UserRate: 0.001, UserBurst: 1}, QuotaConfig{})
+
+	_, err := svc.ApplyTransaction(ctx, win(1, "5", "rl-1"))
+	require.NoError(t, err)
+	res, err := svc.ApplyTransaction(ctx, win(1, "5", "rl-1"))
+	require.NoError(t, err)
+	assert.True(t, res.Replayed)
+
+	_, err = svc.ApplyTransaction(ctx, win(1, "5", "rl-2"))
+	var lerr *LimitError
+	require.ErrorAs(t, err, &lerr)
+	assert.Equal(t, "user_rate_limited", lerr.Code)
+}
+
+func TestBalanceService_QuotaKeptOnUnknownErrors(t *testing.T) {
+	ctx := context.Background()
+	store := brokenStore{NewMemoryStore()}
+	require.NoError(t, store.Init(ctx))
+	svc := NewBalanceService(store)
+	svc.limits = newLimits(RateLimitConfig{}, QuotaConfig{DailyCount: 1})
+
+	// the store may have committed before failing, the quota isn't given back
+	_, err := svc.ApplyTransaction(ctx, win(1, "5", "qk-1"))
+	require.Error(t, err)
+	_, err = svc.ApplyTransaction(ctx, win(1, "5", "qk-2"))
+	var lerr *LimitError
+	require.ErrorAs(t, err, &lerr)
+	assert.Equal(t, "daily_quota_exceeded", lerr.Code)
+}
+
+func TestParseSourceRates(t *testing.T) {
+	rates, err := parseSourceRates(" payment=5, game=200.5,")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"payment": 5, "game": 200.5}, rates)
+
+	for _, spec := range []string{"payment", "=5", "game=fast", "game=-1"} {
+		_, err := parseSourceRates(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestBalanceService_DailyQuotas(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newTestService(t)
+	svc.limits = newLimits(RateLimitConfig{}, QuotaConfig{DailyCount: 2})
+
+	_, err := svc.ApplyTransaction(ctx, win(1, "5", "q-1"))
+	require.NoError(t, err)
+	// neither a replay nor a refused transaction uses the quota
+	res, err := svc.ApplyTransaction(ctx, win(1, "5", "q-1"))
+	require.NoError(t, err)
+	assert.True(t, res.Replayed)
+	_, err = svc.ApplyTransaction(ctx, lose(1, "50", "q-2"))
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+
+	_, err = svc.ApplyTransaction(ctx, lose(1, "1", "q-3"))
+	require.NoError(t, err)
+	_, err = svc.ApplyTransaction(ctx, win(1, "1", "q-4"))
+	var lerr *LimitError
+	require.ErrorAs(t, err, &lerr)
+	assert.Equal(t, "daily_quota_exceeded", lerr.Code)
+	assert.LessOrEqual(t, lerr.RetryAfter, 24*time.Hour, "until the next UTC midnight")
+
+	// quotas are per source
+	cmd := win(1, "1", "q-5")
+	cmd.SourceType = "payment"
+	_, err = svc.ApplyTransaction(ctx, cmd)
+	assert.NoError(t, err)
+
+	balance, _ := store.GetUserBalance(ctx, 1)
+	assert.Equal(t, 5.0, balance)
+}
+
+func TestBalanceService_QuotaReleasedForUnknownUser(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newTestService(t)
+	svc.limits = newLimits(RateLimitConfig{}, QuotaConfig{DailyCount: 1})
+
+	_, err := svc.ApplyTransaction(ctx, win(999, "5", "qu-1"))
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	_, err = svc.ApplyTransaction(ctx, win(1, "5", "qu-2"))
+	assert.NoError(t, err, "the refused transaction gave its quota back")
+}
+
+func TestBalanceService_ReversalsAreLimited(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newTestService(t)
+	for _, id := range []string{"rv-1", "rv-2"} {
+		_, err := svc.ApplyTransaction(ctx, win(1, "5", id))
+		require.NoError(t, err)
+	}
+	svc.limits = newLimits(RateLimitConfig{Sources: map[string]float64{"server": 0.001}}, QuotaConfig{})
+
+	_, err := svc.Reverse(ctx, ReverseCommand{TransactionID: "rv-1", SourceType: "server"})
+	require.NoError(t, err)
+	// a replay of the reversal is answered without a token
+	res, err := svc.Reverse(ctx, ReverseCommand{TransactionID: "rv-1", SourceType: "server"})
+	require.NoError(t, err)
+	assert.True(t, res.Replayed)
+
+	_, err = svc.Reverse(ctx, ReverseCommand{TransactionID: "rv-2", SourceType: "server"})
+	var lerr *LimitError
+	require.ErrorAs(t, err, &lerr)
+	assert.Equal(t, "source_rate_limited", lerr.Code)
+	balance, _ := store.GetUserBalance(ctx, 1)
+	assert.Equal(t, 5.0, balance, "the refused reversal moved nothing")
+
+	// and they use the daily quota of their source
+	svc.limits = newLimits(RateLimitConfig{}, QuotaConfig{DailyCount: 1})
+	_, err = svc.ApplyTransaction(ctx, ApplyTransactionCommand{UserID: 1, SourceType: "server", State: "win", Amount: "1", TransactionID: "rv-3"})
+	require.NoError(t, err)
+	_, err = svc.Reverse(ctx, ReverseCommand{TransactionID: "rv-2", SourceType: "server"})
+	require.ErrorAs(t, err, &lerr)
+	assert.Equal(t, "daily_quota_exceeded", lerr.Code)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// defaultMaxReplicaLag is how far behind the primary a replica may be and still serve reads
+const defaultMaxReplicaLag = 5 * time.Second
+
+// replicaLagCheckInterval limits how often the replica is asked for its lag
+const replicaLagCheckInterval = time.Second
+
+type consistencyKey struct{}
+
+// WithStrongConsistency marks ctx so reads are served by the primary and
+// always see the latest committed writes
+func WithStrongConsistency(ctx context.Context) context.Context {
+	return context.WithValue(ctx, consistencyKey{}, true)
+}
+
+func strongConsistency(ctx context.Context) bool {
+	strong, _ := ctx.Value(consistencyKey{}).(bool)
+	return strong
+}
+
+// replicaLagCheckTimeout bounds a lag check, a hanging replica counts as lagging
+const replicaLagCheckTimeout = time.Second
+
+// replicaReader routes reads to a streaming replica as long as its
+// replication lag stays under maxLag
+type replicaReader struct {
+	db     *sql.DB
+	maxLag time.Duration
+
+	// mu guards the cached answer, it is never held during a lag check
+	mu        sync.Mutex
+	checkedAt time.Time
+	healthy   bool
+	checking  bool
+}
+
+func newReplicaReader(db *sql.DB, maxLag time.Duration) *replicaReader {
+	return &replicaReader{db: db, maxLag: maxLag}
+}
+
+// usable reports whether the replica may serve a read now. The answer is
+// cached for replicaLagCheckInterval and one read at a time refreshes it,
+// the others keep the cached answer meanwhile. An unreachable replica is
+// treated as lagging so reads fall back to the primary.
+func (r *replicaReader) usable(ctx context.Context) bool {
+	r.mu.Lock()
+	if r.checking || time.Since(r.checkedAt) < replicaLagCheckInterval {
+		healthy := r.healthy
+		r.mu.Unlock()
+		return healthy
+	}
+	r.checking = true
+	r.mu.Unlock()
+
+	// the check outlives a read that gives up, its answer serves the next ones
+	checkCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), replicaLagCheckTimeout)
+	lag, err := r.lag(checkCtx)
+	cancel()
+
+	healthy := false
+	switch {
+	case err != nil:
+		slog.WarnContext(ctx, "replica lag check failed, reading from primary", "error", err)
+	case lag > r.maxLag:
+		slog.WarnContext(ctx, "replica is lagging, reading from primary",
+			"lag_ms", lag.Milliseconds(), "max_lag_ms", r.maxLag.Milliseconds())
+	default:
+		healthy = true
+	}
+
+	r.mu.Lock()
+	r.healthy = healthy
+	r.checkedAt = time.Now()
+	r.checking = false
+	r.mu.Unlock()
+	return healthy
+}
+
+// lag is the age of the last replayed transaction. A replica with nothing
+// left to replay is caught up whatever the timestamp says.
+func (r *replicaReader) lag(ctx context.Context) (time.Duration, error) {
+	var seconds float64
+	err := r.db.QueryRowContext(ctx, `
+		SELECT CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		       ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END`).Scan(&seconds)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newReplicatedStore(t *testing.T) (*PostgresStore, sqlmock.Sqlmock, sqlmock.Sqlmock) {
+	primary, primaryMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	replica, replicaMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		primary.Close()
+		replica.Close()
+	})
+	return &PostgresStore{Db: primary, replica: newReplicaReader(replica, time.Second)}, primaryMock, replicaMock
+}
+
+func expectLag(mock sqlmock.Sqlmock, seconds float64) {
+	mock.ExpectQuery("pg_last_xact_replay_timestamp").
+		WillReturnRows(sqlmock.NewRows([]string{"lag"}).AddRow(seconds))
+}
+
+func expectBalance(mock sqlmock.Sqlmock, balance float64) {
+	mock.ExpectQuery("SELECT balance FROM users WHERE user_id = \\$1").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(balance))
+}
+
+func TestGetUserBalance_ReadsFromReplica(t *testing.T) {
+	store, primaryMock, replicaMock := newReplicatedStore(t)
+	expectLag(replicaMock, 0.2)
+	expectBalance(replicaMock, 42.0)
+
+	balance, err := store.GetUserBalance(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 42.0, balance)
+
+	// the lag is cached, the next read goes straight to the replica
+	expectBalance(replicaMock, 43.0)
+	balance, err = store.GetUserBalance(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 43.0, balance)
+
+	assert.NoError(t, replicaMock.ExpectationsWereMet())
+	assert.NoError(t, primaryMock.ExpectationsWereMet())
+}
+
+func TestGetUserBalance_StrongConsistencyReadsFromPrimary(t *testing.T) {
+	store, primaryMock, replicaMock := newReplicatedStore(t)
+	expectBalance(primaryMock, 42.0)
+
+	balance, err := store.GetUserBalance(WithStrongConsistency(context.Background()), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 42.0, balance)
+
+	assert.NoError(t, primaryMock.ExpectationsWereMet())
+	assert.NoError(t, replicaMock.ExpectationsWereMet())
+}
+
+func TestHistory_StrongConsistencyReadsFromPrimary(t *testing.T) {
+	store, primaryMock, replicaMock := newReplicatedStore(t)
+	expectBalance(primaryMock, 42.0)
+	primaryMock.ExpectQuery("FROM transactions WHERE user_id = \\$1").
+		WithArgs(1, 0, 50).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "transaction_id", "user_id", "state", "amount", "source_type", "created_at"}).
+			AddRow(7, "txn-own-write", 1, "win", 42.0, "game", time.Now()))
+
+	page, err := NewBalanceService(store).History(context.Background(), HistoryQuery{UserID: 1, StrongConsistency: true})
+	assert.NoError(t, err)
+	assert.Len(t, page.Transactions, 1)
+
+	assert.NoError(t, primaryMock.ExpectationsWereMet())
+	assert.NoError(t, replicaMock.ExpectationsWereMet())
+}
+
+func TestGetUserBalance_LaggingReplicaFallsBackToPrimary(t *testing.T) {
+	store, primaryMock, replicaMock := newReplicatedStore(t)
+	expectLag(replicaMock, 30)
+	expectBalance(primaryMock, 42.0)
+
+	balance, err := store.GetUserBalance(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 42.0, balance)
+
+	assert.NoError(t, primaryMock.ExpectationsWereMet())
+	assert.NoError(t, replicaMock.ExpectationsWereMet())
+}
+
+func TestGetUserBalance_UnreachableReplicaFallsBackToPrimary(t *testing.T) {
+	store, primaryMock, replicaMock := newReplicatedStore(t)
+	replicaMock.ExpectQuery("pg_last_xact_replay_timestamp").WillReturnError(errors.New("connection refused"))
+	expectBalance(primaryMock, 42.0)
+
+	balance, err := store.GetUserBalance(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 42.0, balance)
+
+	assert.NoError(t, primaryMock.ExpectationsWereMet())
+	assert.NoError(t, replicaMock.ExpectationsWereMet())
+}
+
+func TestReplicaReader_SlowLagCheckDoesNotBlockReads(t *testing.T) {
+	store, _, replicaMock := newReplicatedStore(t)
+	replicaMock.ExpectQuery("pg_last_xact_replay_timestamp").
+		WillDelayFor(time.Minute).
+		WillReturnRows(sqlmock.NewRows([]string{"lag"}).AddRow(0))
+
+	checked := make(chan bool)
+	go func() { checked <- store.replica.usable(context.Background()) }()
+	assert.Eventually(t, func() bool {
+		store.replica.mu.Lock()
+		defer store.replica.mu.Unlock()
+		return store.replica.checking
+	}, time.Second, time.Millisecond)
+
+	start := time.Now()
+	assert.False(t, store.replica.usable(context.Background()), "reads go to the primary while the check runs")
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	select {
+	case healthy := <-checked:
+		assert.False(t, healthy, "a hanging replica counts as lagging")
+	case <-time.After(2 * replicaLagCheckTimeout):
+		t.Fatal("the lag check isn't bounded")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// RetryPolicy is a capped exponential backoff with full jitter
+type RetryPolicy struct {
+	// MaxAttempts counts the first try, values below 2 disable retries
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// defaultConnectRetry waits for the database for roughly a minute on startup
+var defaultConnectRetry = RetryPolicy{MaxAttempts: 10, InitialBackoff: 500 * time.Millisecond, MaxBackoff: 10 * time.Second}
+
+// defaultCASRetry retries optimistic balance updates that lost a version race,
+// conflicts are cheap to retry and expected on hot users
+var defaultCASRetry = RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+
+// defaultTxRetry retries a transaction unit a couple of times within a request budget
+var defaultTxRetry = RetryPolicy{MaxAttempts: 3, InitialBackoff: 20 * time.Millisecond, MaxBackoff: 500 * time.Millisecond}
+
+// Backoff returns how long to wait before retry number attempt (1-based)
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	ceiling := p.InitialBackoff << (attempt - 1)
+	if ceiling <= 0 || ceiling > p.MaxBackoff {
+		ceiling = p.MaxBackoff
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// retryTransient runs op until it succeeds, fails with a non-transient error,
+// runs out of attempts or ctx is done
+func retryTransient(ctx context.Context, p RetryPolicy, op func() error) error {
+	return retryIf(ctx, p, isTransientError, func(attempt int, delay time.Duration, err error) {
+		slog.WarnContext(ctx, "retrying after transient database error",
+			"attempt", attempt, "delay_ms", delay.Milliseconds(), "error", err)
+	}, op)
+}
+
+// retryIf runs op until it succeeds, fails with an error retryable rejects,
+// runs out of attempts or ctx is done. onRetry is called before each wait.
+func retryIf(ctx context.Context, p RetryPolicy, retryable func(error) bool, onRetry func(attempt int, delay time.Duration, err error), op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= p.MaxAttempts || !retryable(err) {
+			return err
+		}
+
+		delay := p.Backoff(attempt)
+		onRetry(attempt, delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// transientSQLStates are Postgres error codes worth retrying the whole unit for
+var transientSQLStates = map[pq.ErrorCode]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"53300": true, // too_many_connections
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+}
+
+// isTransientError reports whether err is a connection or concurrency failure
+// that may succeed when retried. Cancellation and deadlines never are.
+func isTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// class 08 is connection_exception
+		return transientSQLStates[pqErr.Code] || pqErr.Code.Class() == "08"
+	}
+
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTransientError(t *testing.T) {
+	transient := []error{
+		&pq.Error{Code: "40001"},
+		&pq.Error{Code: "40P01"},
+		&pq.Error{Code: "57P01"},
+		&pq.Error{Code: "08006"},
+		fmt.Errorf("wrapped: %w", &pq.Error{Code: "08003"}),
+		driver.ErrBadConn,
+		io.EOF,
+		syscall.ECONNRESET,
+		&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED},
+	}
+	for _, err := range transient {
+		assert.True(t, isTransientError(err), "%v should be transient", err)
+	}
+
+	permanent := []error{
+		nil,
+		sql.ErrNoRows,
+		ErrInsufficientFunds,
+		ErrDuplicateTransaction,
+		&pq.Error{Code: "23505"}, // unique_violation
+		&pq.Error{Code: "28P01"}, // invalid_password
+		context.Canceled,
+		context.DeadlineExceeded,
+	}
+	for _, err := range permanent {
+		assert.False(t, isTransientError(err), "%v should not be transient", err)
+	}
+}
+
+func TestRetryTransient(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	attempts := 0
+	err := retryTransient(context.Background(), policy, func() error {
+		attempts++
+		if attempts < 3 {
+			return &pq.Error{Code: "40001"}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = retryTransient(context.Background(), policy, func() error {
+		attempts++
+		return driver.ErrBadConn
+	})
+	assert.ErrorIs(t, err, driver.ErrBadConn)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = retryTransient(context.Background(), policy, func() error {
+		attempts++
+		return ErrInsufficientFunds
+	})
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryTransient_StopsOnContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+
+	attempts := 0
+	err := retryTransient(ctx, policy, func() error {
+		attempts++
+		cancel()
+		return syscall.ECONNRESET
+	})
+	assert.ErrorIs(t, err, syscall.ECONNRESET)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt := 1; attempt <= 10; attempt++ {
+		delay := policy.Backoff(attempt)
+		assert.GreaterOrEqual(t, delay, time.Duration(0))
+		assert.LessOrEqual(t, delay, time.Second)
+	}
+	assert.LessOrEqual(t, policy.Backoff(1), 100*time.Millisecond)
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// reversalPrefix marks the transaction that reverses the one whose ID follows
+const reversalPrefix = "reversal:"
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// defaultMaxAmount bounds a single transaction unless WithMaxAmount says otherwise
+const defaultMaxAmount = 1_000_000
+
+// maxTransactionIDLength leaves room for the reversal prefix in the column
+const maxTransactionIDLength = 128
+
+// maxSourceTypeLength is the width of the source_type columns
+const maxSourceTypeLength = 50
+
+var (
+	// amountPattern is an unsigned decimal, without exponent, spaces or leading zeros
+	amountPattern      = regexp.MustCompile(`^(0|[1-9][0-9]*)(\.[0-9]+)?$`)
+	validTransactionID = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+	validSourceType    = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+)
+
+var (
+	ErrUserNotFound        = errors.New("user not found")
+	ErrTransactionNotFound = errors.New("transaction not found")
+	ErrNotReversible       = errors.New("a reversal cannot be reversed")
+)
+
+// ValidationError reports a request refused before any storage call. Code is
+// a stable identifier of the failed check, Message is meant for the client and
+// Field names the offending input.
+type ValidationError struct {
+	Field   string
+	Code    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func invalid(field, code, msg string) *ValidationError {
+	return &ValidationError{Field: field, Code: code, Message: msg}
+}
+
+// ApplyTransactionCommand is a win or lose reported by a provider. Amount is
+// kept as sent, the service parses and validates it.
+type ApplyTransactionCommand struct {
+	UserID        uint64
+	SourceType    string
+	State         string
+	Amount        string
+	TransactionID string
+}
+
+// ApplyTransactionResult tells how a command changed the balance. A command
+// repeating a known transaction ID is Replayed and changes nothing.
+type ApplyTransactionResult struct {
+	Replayed bool
+	Delta    float64
+}
+
+// BalanceQuery reads the balance of a user, from the primary when
+// StrongConsistency is set
+type BalanceQuery struct {
+	UserID            uint64
+	StrongConsistency bool
+}
+
+type BalanceResult struct {
+	UserID  uint64
+	Balance float64
+}
+
+// HistoryQuery asks for a page of a user's transactions, newest first, below
+// BeforeID when it isn't 0. A Limit of 0 picks the default page size.
+type HistoryQuery struct {
+	UserID   uint64
+	BeforeID int64
+	Limit    int
+	// StrongConsistency reads from the primary, like BalanceQuery
+	StrongConsistency bool
+}
+
+// HistoryPage is one page of transactions. NextBeforeID is the BeforeID of
+// the next page, 0 on the last one.
+type HistoryPage struct {
+	Transactions []Transaction
+	NextBeforeID int64
+}
+
+// ReverseCommand undoes the transaction TransactionID
+type ReverseCommand struct {
+	TransactionID string
+	SourceType    string
+}
+
+// ReverseResult holds the stored compensating transaction. Reversing again
+// returns the same one, Replayed.
+type ReverseResult struct {
+	Reversal Transaction
+	Replayed bool
+}
+
+// BalanceService holds the rules shared by the HTTP, WebSocket and gRPC
+// transports: validation, idempotency and the storage calls. It returns
+// domain errors and *ValidationError, each transport maps them to its own
+// status codes.
+type BalanceService struct {
+	store Storage
+	// maxAmount bounds the amount of a transaction, 0 for no limit
+	maxAmount float64
+
+	queue *userQueue
+	// limits holds the rate limits and daily quotas, nil when none is set
+	limits   *limits
+	metrics  *Metrics
+	tracer   *Tracer
+	logger   *slog.Logger
+	webhooks *WebhookService
+}
+
+// NewBalanceService returns a service over store with the server defaults:
+// per-user queueing, no tracing exporter and no webhooks
+func NewBalanceService(store Storage) *BalanceService {
+	return &BalanceService{
+		store:     store,
+		maxAmount: defaultMaxAmount,
+		queue:     newUserQueue(defaultUserQueueDepth),
+		metrics:   NewMetrics(),
+		tracer:    NewTracer(nil),
+		logger:    slog.Default(),
+	}
+}
+
+// ApplyTransaction validates cmd and applies it to the user's balance
+func (b *BalanceService) ApplyTransaction(ctx context.Context, cmd ApplyTransactionCommand) (ApplyTransactionResult, error) {
+	annotateRequest(ctx, slog.String("transactionId", cmd.TransactionID), slog.String("state", cmd.State))
+
+	tx, delta, err := b.validateTransaction(cmd)
+	if err != nil {
+		return ApplyTransactionResult{}, err
+	}
+
+	replayed, err := b.record(ctx, tx, delta)
+	if err != nil || replayed {
+		return ApplyTransactionResult{Replayed: replayed}, err
+	}
+	return ApplyTransactionResult{Delta: delta}, nil
+}
+
+// record applies a validated transaction, or a reversal, within the rate
+// limits and daily quota of its source. A known transaction ID is a replay.
+func (b *BalanceService) record(ctx context.Context, tx Transaction, delta float64) (replayed bool, err error) {
+	// Check if transaction ID already exists
+	var existingTx *Transaction
+	err = b.traceStore(ctx, "GetTransactionByID", func(ctx context.Context) (err error) {
+		existingTx, err = b.store.GetTransactionByID(ctx, tx.TransactionID)
+		return err
+	})
+	if isTimeout(err) {
+		return false, err
+	}
+	if err == nil && existingTx != nil {
+		// Transaction already processed
+		b.replayed(ctx, tx.SourceType)
+		return true, nil
+	}
+
+	// replays are answered above without using the limits
+	if lerr := b.limits.allow(tx); lerr != nil {
+		b.limited(ctx, tx.SourceType, lerr)
+		return false, lerr
+	}
+
+	release, err := b.consumeQuota(ctx, tx)
+	if err != nil {
+		var lerr *LimitError
+		if errors.As(err, &lerr) {
+			b.limited(ctx, tx.SourceType, lerr)
+		} else if !isTimeout(err) {
+			b.logger.ErrorContext(ctx, "failed to consume quota", "error", err)
+		}
+		return false, err
+	}
+
+	replayed, err = b.apply(ctx, tx, delta)
+	if replayed || notApplied(err) {
+		release()
+	}
+	return replayed, err
+}
+
+func (b *BalanceService) limited(ctx context.Context, sourceType string, lerr *LimitError) {
+	b.metrics.ObserveLimited(sourceType, lerr.Code)
+	setOutcome(ctx, lerr.Code)
+}
+
+// validateTransaction turns cmd into the transaction to record and the
+// balance change it makes
+func (b *BalanceService) validateTransaction(cmd ApplyTransactionCommand) (Transaction, float64, error) {
+	if err := validateSourceType(cmd.SourceType); err != nil {
+		return Transaction{}, 0, err
+	}
+
+	// Validate state
+	if cmd.State != "win" && cmd.State != "lose" {
+		return Transaction{}, 0, invalid("state", "invalid_state", "Invalid state value")
+	}
+
+	if err := validateTransactionID(cmd.TransactionID); err != nil {
+		return Transaction{}, 0, err
+	}
+
+	// Validate amount
+	amount, err := b.parseAmount(cmd.Amount)
+	if err != nil {
+		return Transaction{}, 0, err
+	}
+
+	// Determine balance delta
+	delta := amount
+	if cmd.State == "lose" {
+		delta = -amount
+	}
+
+	return Transaction{
+		TransactionID: cmd.TransactionID,
+		UserID:        cmd.UserID,
+		State:         cmd.State,
+		Amount:        amount,
+		SourceType:    cmd.SourceType,
+		CreatedAt:     timeNowUTC(),
+	}, delta, nil
+}
+
+func validateSourceType(sourceType string) error {
+	switch {
+	case sourceType == "":
+		return invalid("sourceType", "missing_source_type", "Missing Source-Type header")
+	case len(sourceType) > maxSourceTypeLength || !validSourceType.MatchString(sourceType):
+		return invalid("sourceType", "invalid_source_type", fmt.Sprintf("Source-Type must be at most %d letters, digits, '.', '_' or '-'", maxSourceTypeLength))
+	}
+	return nil
+}
+
+func validateTransactionID(id string) error {
+	switch {
+	case id == "":
+		return invalid("transactionId", "missing_transaction_id", "Missing transactionId")
+	case len(id) > maxTransactionIDLength:
+		return invalid("transactionId", "transaction_id_too_long", fmt.Sprintf("transactionId must be at most %d characters", maxTransactionIDLength))
+	case !validTransactionID.MatchString(id):
+		return invalid("transactionId", "invalid_transaction_id", "transactionId may only contain letters, digits, '.', '_', ':' and '-'")
+	case strings.HasPrefix(id, reversalPrefix):
+		return invalid("transactionId", "reserved_transaction_id", "transaction IDs starting with "+reversalPrefix+" are reserved")
+	}
+	return nil
+}
+
+// parseAmount reads a positive amount of at most 2 decimal places. Signs,
+// exponents, spaces, NaN and Inf, all accepted by strconv.ParseFloat, are not.
+func (b *BalanceService) parseAmount(s string) (float64, error) {
+	m := amountPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, invalid("amount", "invalid_amount", "Invalid amount format")
+	}
+	if len(m[2]) > 3 {
+		return 0, invalid("amount", "amount_precision", "Amount must have up to 2 decimal places")
+	}
+	amount, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, invalid("amount", "invalid_amount", "Invalid amount format")
+	}
+	if amount == 0 {
+		return 0, invalid("amount", "amount_not_positive", "Amount must be greater than zero")
+	}
+	if b.maxAmount > 0 && amount > b.maxAmount {
+		return 0, invalid("amount", "amount_too_large", "Amount must not exceed "+formatAmount(b.maxAmount))
+	}
+	return amount, nil
+}
+
+// apply records tx and updates the balance atomically, once per transaction ID
+func (b *BalanceService) apply(ctx context.Context, tx Transaction, delta float64) (replayed bool, err error) {
+	shared, err := b.queue.Do(ctx, tx.UserID, tx.TransactionID, func(ctx context.Context) error {
+		return b.traceStore(ctx, "ApplyTransaction", func(ctx context.Context) error {
+			return b.store.ApplyTransaction(ctx, tx, delta)
+		})
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		// the stores find no balance row to update for an unknown user
+		err = ErrUserNotFound
+	}
+	switch {
+	case shared && err == nil, errors.Is(err, ErrDuplicateTransaction):
+		// the same transactionId was in flight, or a concurrent request won the race
+		b.replayed(ctx, tx.SourceType)
+		return true, nil
+	case errors.Is(err, errQueueFull):
+		b.metrics.ObserveQueueRejected(tx.SourceType)
+		setOutcome(ctx, "queue_full")
+	case errors.Is(err, ErrInsufficientFunds):
+		setOutcome(ctx, "insufficient_funds")
+		if !shared {
+			// the request that ran the transaction reports the rejection once
+			b.metrics.ObserveInsufficientFunds(tx.SourceType)
+			b.publishRejection(ctx, tx, "insufficient_funds")
+		}
+	case errors.Is(err, ErrConcurrentUpdate):
+		// nothing was recorded, the client can safely retry with the same transactionId
+		setOutcome(ctx, "conflict")
+	case errors.Is(err, ErrUserNotFound):
+		setOutcome(ctx, "user_not_found")
+	case err != nil && !isTimeout(err):
+		b.logger.ErrorContext(ctx, "failed to apply transaction", "shared", shared, "error", err)
+	case err == nil:
+		b.metrics.ObserveTransaction(tx.State, tx.SourceType, tx.Amount)
+	}
+	return false, err
+}
+
+func (b *BalanceService) replayed(ctx context.Context, sourceType string) {
+	b.metrics.ObserveReplay(sourceType)
+	setOutcome(ctx, "already_processed")
+}
+
+// Balance returns the balance of a user. Any failure but a timeout is
+// reported as ErrUserNotFound.
+func (b *BalanceService) Balance(ctx context.Context, q BalanceQuery) (BalanceResult, error) {
+	if q.StrongConsistency {
+		ctx = WithStrongConsistency(ctx)
+	}
+	var balance float64
+	err := b.traceStore(ctx, "GetUserBalance", func(ctx context.Context) (err error) {
+		balance, err = b.store.GetUserBalance(ctx, q.UserID)
+		return err
+	})
+	if isTimeout(err) {
+		return BalanceResult{}, err
+	}
+	if err != nil {
+		return BalanceResult{}, ErrUserNotFound
+	}
+	return BalanceResult{UserID: q.UserID, Balance: balance}, nil
+}
+
+// History returns a page of the user's transactions
+func (b *BalanceService) History(ctx context.Context, q HistoryQuery) (HistoryPage, error) {
+	if q.Limit == 0 {
+		q.Limit = defaultHistoryLimit
+	}
+	if q.Limit < 1 || q.Limit > maxHistoryLimit {
+		return HistoryPage{}, invalid("limit", "invalid_limit", "Invalid limit")
+	}
+	if q.BeforeID < 0 {
+		return HistoryPage{}, invalid("beforeId", "invalid_before_id", "Invalid beforeId")
+	}
+	if q.StrongConsistency {
+		ctx = WithStrongConsistency(ctx)
+	}
+	if _, err := b.Balance(ctx, BalanceQuery{UserID: q.UserID, StrongConsistency: q.StrongConsistency}); err != nil {
+		return HistoryPage{}, err
+	}
+
+	var txs []Transaction
+	err := b.traceStore(ctx, "ListTransactions", func(ctx context.Context) (err error) {
+		txs, err = b.store.ListTransactions(ctx, q.UserID, q.BeforeID, q.Limit)
+		return err
+	})
+	if err != nil {
+		return HistoryPage{}, err
+	}
+	page := HistoryPage{Transactions: txs}
+	if len(txs) == q.Limit {
+		page.NextBeforeID = txs[len(txs)-1].ID
+	}
+	return page, nil
+}
+
+// Reverse undoes a transaction with a compensating one recorded as
+// reversal:<transactionId>
+func (b *BalanceService) Reverse(ctx context.Context, cmd ReverseCommand) (ReverseResult, error) {
+	annotateRequest(ctx, slog.String("transactionId", cmd.TransactionID), slog.String("state", "reversal"))
+
+	if err := validateSourceType(cmd.SourceType); err != nil {
+		return ReverseResult{}, err
+	}
+	if strings.HasPrefix(cmd.TransactionID, reversalPrefix) {
+		return ReverseResult{}, ErrNotReversible
+	}
+	if err := validateTransactionID(cmd.TransactionID); err != nil {
+		return ReverseResult{}, err
+	}
+
+	original, err := b.transaction(ctx, cmd.TransactionID)
+	if err != nil {
+		return ReverseResult{}, err
+	}
+
+	reversal := Transaction{
+		TransactionID: reversalPrefix + original.TransactionID,
+		UserID:        original.UserID,
+		State:         "win",
+		Amount:        original.Amount,
+		SourceType:    cmd.SourceType,
+		CreatedAt:     timeNowUTC(),
+	}
+	delta := original.Amount
+	if original.State == "win" {
+		reversal.State = "lose"
+		delta = -original.Amount
+	}
+
+	// a reversal moves money like any transaction, under the same limits
+	replayed, err := b.record(ctx, reversal, delta)
+	if err != nil {
+		return ReverseResult{}, err
+	}
+	// return the stored row, with its ID, whichever request recorded it
+	stored, err := b.transaction(ctx, reversal.TransactionID)
+	if err != nil {
+		return ReverseResult{}, err
+	}
+	return ReverseResult{Reversal: *stored, Replayed: replayed}, nil
+}
+
+func (b *BalanceService) transaction(ctx context.Context, transactionID string) (*Transaction, error) {
+	var tx *Transaction
+	err := b.traceStore(ctx, "GetTransactionByID", func(ctx context.Context) (err error) {
+		tx, err = b.store.GetTransactionByID(ctx, transactionID)
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTransactionNotFound
+	}
+	if err != nil && !isTimeout(err) {
+		b.logger.ErrorContext(ctx, "failed to look up transaction", "error", err)
+	}
+	return tx, err
+}
+
+// traceStore runs a storage call inside a child span of the request span
+func (b *BalanceService) traceStore(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	ctx, span := b.tracer.Start(ctx, "store."+op)
+	defer span.End()
+	span.SetAttribute("db.operation", op)
+
+	err := fn(ctx)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		span.RecordError(err)
+	}
+	return err
+}
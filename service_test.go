@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestService(t *testing.T) (*BalanceService, Storage) {
+	store := NewMemoryStore()
+	require.NoError(t, store.Init(context.Background()))
+	return NewBalanceService(store), store
+}
+
+func win(userID uint64, amount, id string) ApplyTransactionCommand {
+	return ApplyTransactionCommand{UserID: userID, SourceType: "game", State: "win", Amount: amount, TransactionID: id}
+}
+
+func lose(userID uint64, amount, id string) ApplyTransactionCommand {
+	return ApplyTransactionCommand{UserID: userID, SourceType: "game", State: "lose", Amount: amount, TransactionID: id}
+}
+
+func TestBalanceService_ApplyTransaction(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newTestService(t)
+
+	res, err := svc.ApplyTransaction(ctx, win(1, "10.15", "a-1"))
+	require.NoError(t, err)
+	assert.Equal(t, ApplyTransactionResult{Delta: 10.15}, res)
+
+	res, err = svc.ApplyTransaction(ctx, lose(1, "0.15", "a-2"))
+	require.NoError(t, err)
+	assert.Equal(t, ApplyTransactionResult{Delta: -0.15}, res)
+
+	// the same transaction ID is applied once, whatever the payload
+	res, err = svc.ApplyTransaction(ctx, win(1, "99", "a-1"))
+	require.NoError(t, err)
+	assert.Equal(t, ApplyTransactionResult{Replayed: true}, res)
+
+	balance, err := store.GetUserBalance(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 10.0, balance)
+
+	_, err = svc.ApplyTransaction(ctx, lose(1, "10.01", "a-3"))
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	_, err = store.GetTransactionByID(ctx, "a-3")
+	assert.Error(t, err, "a refused transaction isn't recorded")
+}
+
+func TestBalanceService_ApplyTransactionValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		cmd   ApplyTransactionCommand
+		field string
+		msg   string
+	}{
+		{"missing source type", ApplyTransactionCommand{UserID: 1, State: "win", Amount: "1", TransactionID: "v"}, "sourceType", "Missing Source-Type header"},
+		{"invalid state", ApplyTransactionCommand{UserID: 1, SourceType: "game", State: "draw", Amount: "1", TransactionID: "v"}, "state", "Invalid state value"},
+		{"invalid amount", win(1, "abc", "v"), "amount", "Invalid amount format"},
+		{"too many decimals", win(1, "1.001", "v"), "amount", "Amount must have up to 2 decimal places"},
+		{"reserved ID", win(1, "1", "reversal:v"), "transactionId", "transaction IDs starting with reversal: are reserved"},
+		{"missing ID", win(1, "1", ""), "transactionId", "Missing transactionId"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// validation happens before any storage call
+			svc := NewBalanceService(failingStore{})
+			_, err := svc.ApplyTransaction(context.Background(), tt.cmd)
+
+			var verr *ValidationError
+			require.ErrorAs(t, err, &verr)
+			assert.Equal(t, tt.field, verr.Field)
+			assert.Equal(t, tt.msg, verr.Message)
+		})
+	}
+}
+
+// failingStore fails every call, the embedded nil Storage panics on the others
+type failingStore struct {
+	Storage
+}
+
+func (failingStore) GetTransactionByID(ctx context.Context, transactionID string) (*Transaction, error) {
+	return nil, errors.New("storage called")
+}
+
+func (failingStore) GetUserBalance(ctx context.Context, userID uint64) (float64, error) {
+	return 0, errors.New("storage called")
+}
+
+func TestBalanceService_Balance(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newTestService(t)
+	_, err := svc.ApplyTransaction(ctx, win(2, "3.50", "b-1"))
+	require.NoError(t, err)
+
+	res, err := svc.Balance(ctx, BalanceQuery{UserID: 2, StrongConsistency: true})
+	require.NoError(t, err)
+	assert.Equal(t, BalanceResult{UserID: 2, Balance: 3.5}, res)
+
+	_, err = svc.Balance(ctx, BalanceQuery{UserID: 999})
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = NewBalanceService(blockingStore{NewMockStore()}).Balance(cancelled, BalanceQuery{UserID: 1})
+	assert.ErrorIs(t, err, context.Canceled, "a timeout isn't reported as an unknown user")
+}
+
+func TestBalanceService_Reverse(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newTestService(t)
+
+	_, err := svc.ApplyTransaction(ctx, win(1, "20.00", "s-1"))
+	require.NoError(t, err)
+	_, err = svc.ApplyTransaction(ctx, lose(1, "5.00", "s-2"))
+	require.NoError(t, err)
+
+	// reversing a loss credits it back
+	res, err := svc.Reverse(ctx, ReverseCommand{TransactionID: "s-2", SourceType: "server"})
+	require.NoError(t, err)
+	assert.False(t, res.Replayed)
+	assert.Equal(t, "reversal:s-2", res.Reversal.TransactionID)
+	assert.Equal(t, "win", res.Reversal.State)
+	assert.NotZero(t, res.Reversal.ID)
+	balance, _ := store.GetUserBalance(ctx, 1)
+	assert.Equal(t, 20.0, balance)
+
+	again, err := svc.Reverse(ctx, ReverseCommand{TransactionID: "s-2", SourceType: "server"})
+	require.NoError(t, err)
+	assert.True(t, again.Replayed)
+	assert.Equal(t, res.Reversal.ID, again.Reversal.ID)
+
+	_, err = svc.ApplyTransaction(ctx, lose(1, "15.00", "s-3"))
+	require.NoError(t, err)
+	// the win was partly spent, taking it back would go negative
+	_, err = svc.Reverse(ctx, ReverseCommand{TransactionID: "s-1", SourceType: "server"})
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+
+	_, err = svc.Reverse(ctx, ReverseCommand{TransactionID: "reversal:s-2", SourceType: "server"})
+	assert.ErrorIs(t, err, ErrNotReversible)
+	_, err = svc.Reverse(ctx, ReverseCommand{TransactionID: "missing", SourceType: "server"})
+	assert.ErrorIs(t, err, ErrTransactionNotFound)
+	_, err = svc.Reverse(ctx, ReverseCommand{TransactionID: "s-3"})
+	assert.True(t, isValidationError(err))
+	_, err = svc.Reverse(ctx, ReverseCommand{TransactionID: "s 3", SourceType: "server"})
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	assert.Equal(t, "invalid_transaction_id", verr.Code)
+}
+
+func TestBalanceService_History(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newTestService(t)
+
+	page, err := svc.History(ctx, HistoryQuery{UserID: 1})
+	require.NoError(t, err)
+	assert.Empty(t, page.Transactions)
+	assert.Zero(t, page.NextBeforeID)
+
+	for _, id := range []string{"h-1", "h-2", "h-3"} {
+		_, err := svc.ApplyTransaction(ctx, win(1, "1", id))
+		require.NoError(t, err)
+	}
+	page, err = svc.History(ctx, HistoryQuery{UserID: 1, Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, page.Transactions, 2)
+	assert.Equal(t, "h-3", page.Transactions[0].TransactionID)
+	assert.Equal(t, page.Transactions[1].ID, page.NextBeforeID)
+
+	page, err = svc.History(ctx, HistoryQuery{UserID: 1, Limit: 2, BeforeID: page.NextBeforeID})
+	require.NoError(t, err)
+	require.Len(t, page.Transactions, 1)
+	assert.Zero(t, page.NextBeforeID)
+
+	_, err = svc.History(ctx, HistoryQuery{UserID: 999})
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	for _, q := range []HistoryQuery{{UserID: 1, Limit: maxHistoryLimit + 1}, {UserID: 1, Limit: -1}, {UserID: 1, BeforeID: -1}} {
+		_, err = svc.History(ctx, q)
+		assert.True(t, isValidationError(err), "%+v", q)
+	}
+}
+
+func TestBalanceService_StrictValidation(t *testing.T) {
+	tests := []struct {
+		amount string
+		id     string
+		code   string
+	}{
+		{"0", "v", "amount_not_positive"},
+		{"0.00", "v", "amount_not_positive"},
+		{"-5", "v", "invalid_amount"},
+		{"+5", "v", "invalid_amount"},
+		{"1e3", "v", "invalid_amount"},
+		{" 10", "v", "invalid_amount"},
+		{"10 ", "v", "invalid_amount"},
+		{"NaN", "v", "invalid_amount"},
+		{"Inf", "v", "invalid_amount"},
+		{"", "v", "invalid_amount"},
+		{"01.50", "v", "invalid_amount"},
+		{"1.", "v", "invalid_amount"},
+		{".5", "v", "invalid_amount"},
+		{"0x10", "v", "invalid_amount"},
+		{"1.001", "v", "amount_precision"},
+		{"1000000.01", "v", "amount_too_large"},
+		{"1", strings.Repeat("x", maxTransactionIDLength+1), "transaction_id_too_long"},
+		{"1", "txn 1", "invalid_transaction_id"},
+		{"1", "txn/1", "invalid_transaction_id"},
+		{"1", "txn-é", "invalid_transaction_id"},
+	}
+	svc := NewBalanceService(failingStore{})
+	for _, tt := range tests {
+		_, err := svc.ApplyTransaction(context.Background(), win(1, tt.amount, tt.id))
+		var verr *ValidationError
+		if assert.ErrorAs(t, err, &verr, "%q %q", tt.amount, tt.id) {
+			assert.Equal(t, tt.code, verr.Code, "%q %q", tt.amount, tt.id)
+		}
+	}
+
+	svc, _ = newTestService(t)
+	for _, amount := range []string{"0.01", "0.5", "10", "1000000", "1000000.00"} {
+		_, err := svc.ApplyTransaction(context.Background(), win(1, amount, "ok-"+amount))
+		assert.NoError(t, err, amount)
+	}
+	_, err := svc.ApplyTransaction(context.Background(), win(1, "1", strings.Repeat("x", maxTransactionIDLength)))
+	assert.NoError(t, err)
+
+	// 0 lifts the limit
+	svc.maxAmount = 0
+	_, err = svc.ApplyTransaction(context.Background(), win(1, "5000000", "no-limit"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxFrameSize bounds a transaction frame, they are a few dozen bytes
+const maxFrameSize = 4 << 10
+
+// socketWriteTimeout bounds how long an ack may wait on a stalled client
+const socketWriteTimeout = 10 * time.Second
+
+// SocketConfig configures the provider transaction socket
+type SocketConfig struct {
+	// Tokens maps each bearer token to the provider it authenticates. The
+	// provider is the Source-Type of its transactions, so a provider can't
+	// send under the limits and quotas of another source.
+	Tokens map[string]string
+	// Window is how many frames a provider may send ahead of their acks
+	// before the server stops reading
+	Window int
+	// AckHistory is how many acks per provider are kept for resumes
+	AckHistory   int
+	PingInterval time.Duration
+}
+
+func DefaultSocketConfig() SocketConfig {
+	return SocketConfig{
+		Window:       64,
+		AckHistory:   1024,
+		PingInterval: 30 * time.Second,
+	}
+}
+
+// parseProviderTokens reads provider=token pairs separated by commas or newlines
+func parseProviderTokens(spec string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, pair := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		pair = strings.TrimSpace(pair)
+		if pair == "" || strings.HasPrefix(pair, "#") {
+			continue
+		}
+		provider, token, ok := strings.Cut(pair, "=")
+		provider, token = strings.TrimSpace(provider), strings.TrimSpace(token)
+		if !ok || provider == "" || token == "" {
+			return nil, fmt.Errorf("invalid provider token %q, expected provider=token", provider)
+		}
+		if err := validateSourceType(provider); err != nil {
+			return nil, fmt.Errorf("invalid provider %q: %w", provider, err)
+		}
+		if _, dup := tokens[token]; dup {
+			return nil, fmt.Errorf("provider %q reuses the token of another provider", provider)
+		}
+		tokens[token] = provider
+	}
+	return tokens, nil
+}
+
+// TransactionFrame is a transaction sent over the provider socket
+type TransactionFrame struct {
+	UserID uint64 `json:"userId"`
+	TransactionRequest
+}
+
+// TransactionAck answers a TransactionFrame. Acks come in the order the
+// frames were sent and carry the outcome POST /user/{userId}/transaction
+// would have had: Code is its HTTP status, with Status on success and Error
+// otherwise. ErrorCode and RetryAfter, in seconds, are the Error-Code and
+// Retry-After headers of a refused frame.
+type TransactionAck struct {
+	Type          string `json:"type"`
+	TransactionID string `json:"transactionId"`
+	UserID        uint64 `json:"userId"`
+	Code          int    `json:"code"`
+	Status        string `json:"status,omitempty"`
+	Error         string `json:"error,omitempty"`
+	ErrorCode     string `json:"errorCode,omitempty"`
+	RetryAfter    int    `json:"retryAfter,omitempty"`
+}
+
+// socketHello is the first message of a connection
+type socketHello struct {
+	Type     string `json:"type"`
+	Provider string `json:"provider"`
+	Window   int    `json:"window"`
+	// Resumed tells whether the acks after lastAcked follow, otherwise the
+	// provider resends every frame it has no ack for
+	Resumed bool `json:"resumed"`
+}
+
+// socketGateway authenticates providers and keeps their recent acks
+type socketGateway struct {
+	cfg      SocketConfig
+	upgrader websocket.Upgrader
+	open     atomic.Int64
+
+	mu   sync.Mutex
+	acks map[string][]TransactionAck
+}
+
+func newSocketGateway(cfg SocketConfig) *socketGateway {
+	return &socketGateway{
+		cfg:  cfg,
+		acks: make(map[string][]TransactionAck),
+	}
+}
+
+// authenticate returns the provider of the request's bearer token
+func (g *socketGateway) authenticate(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+	for known, provider := range g.cfg.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return provider, true
+		}
+	}
+	return "", false
+}
+
+func (g *socketGateway) record(provider string, ack TransactionAck) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	log := append(g.acks[provider], ack)
+	if len(log) > g.cfg.AckHistory {
+		log = append(log[:0], log[len(log)-g.cfg.AckHistory:]...)
+	}
+	g.acks[provider] = log
+}
+
+// acksAfter returns the acks recorded after the one of transactionID, false
+// when that ack is no longer known
+func (g *socketGateway) acksAfter(provider, transactionID string) ([]TransactionAck, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	log := g.acks[provider]
+	for i := len(log) - 1; i >= 0; i-- {
+		if log[i].TransactionID == transactionID {
+			return append([]TransactionAck(nil), log[i+1:]...), true
+		}
+	}
+	return nil, false
+}
+
+// HandleTransactionSocket serves GET /transactions/ws, a WebSocket on which
+// an authenticated provider streams TransactionFrames and reads TransactionAcks.
+// A provider reconnecting with ?lastAcked=<transactionId> first gets the acks
+// it missed; frames without an ack can be resent, transactions are idempotent.
+func (s *APIServer) HandleTransactionSocket(w http.ResponseWriter, r *http.Request) {
+	provider, ok := s.sockets.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="transactions"`)
+		http.Error(w, "Invalid or missing provider token", http.StatusUnauthorized)
+		return
+	}
+	// the token decides the source, a header may only repeat it
+	sourceType := provider
+	if h := r.Header.Get("Source-Type"); h != "" && h != sourceType {
+		http.Error(w, "Source-Type does not match the provider token", http.StatusForbidden)
+		return
+	}
+
+	conn, err := s.sockets.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already answered the client
+		return
+	}
+	defer conn.Close()
+	s.sockets.open.Add(1)
+	defer s.sockets.open.Add(-1)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	logger := s.logger.With("provider", provider)
+	logger.InfoContext(ctx, "provider socket opened")
+
+	hello := socketHello{Type: "hello", Provider: provider, Window: s.sockets.cfg.Window}
+	var missed []TransactionAck
+	if lastAcked := r.URL.Query().Get("lastAcked"); lastAcked != "" {
+		missed, hello.Resumed = s.sockets.acksAfter(provider, lastAcked)
+	}
+	if err := writeSocketJSON(conn, hello); err != nil {
+		return
+	}
+	for _, ack := range missed {
+		if err := writeSocketJSON(conn, ack); err != nil {
+			return
+		}
+	}
+
+	// frames buffers at most Window frames, then reading stops and TCP
+	// pushes back on the provider
+	frames := make(chan []byte, s.sockets.cfg.Window)
+	go s.readFrames(ctx, conn, frames)
+
+	ping := time.NewTicker(s.sockets.cfg.PingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case data, ok := <-frames:
+			if !ok {
+				logger.InfoContext(ctx, "provider socket closed")
+				return
+			}
+			ack := s.handleFrame(ctx, sourceType, data)
+			s.sockets.record(provider, ack)
+			if err := writeSocketJSON(conn, ack); err != nil {
+				logger.WarnContext(ctx, "provider socket write failed", "error", err)
+				return
+			}
+		case <-ping.C:
+			deadline := time.Now().Add(socketWriteTimeout)
+			if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readFrames feeds frames until the connection fails or is closed
+func (s *APIServer) readFrames(ctx context.Context, conn *websocket.Conn, frames chan<- []byte) {
+	defer close(frames)
+
+	// a missed pong or a silent client ends the connection
+	idle := 2 * s.sockets.cfg.PingInterval
+	conn.SetReadLimit(maxFrameSize)
+	conn.SetReadDeadline(time.Now().Add(idle))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(idle))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(idle))
+		select {
+		case frames <- data:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleFrame applies one frame like HandleTransaction applies a request
+func (s *APIServer) handleFrame(ctx context.Context, sourceType string, data []byte) TransactionAck {
+	var frame TransactionFrame
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&frame); err != nil {
+		return TransactionAck{Type: "ack", Code: http.StatusBadRequest, Error: "Invalid JSON frame", ErrorCode: bodyError(err).Code}
+	}
+
+	// frames are logged and traced one by one, not on the connection's access log line
+	rl := &requestLog{}
+	if parent := requestLogFromContext(ctx); parent != nil {
+		rl.requestID = parent.requestID
+	}
+	ctx = context.WithValue(ctx, requestLogKey{}, rl)
+	ctx, span := s.tracer.Start(ctx, "socket.transaction")
+	defer span.End()
+	span.SetAttribute("user.id", frame.UserID)
+	span.SetAttribute("transaction.id", frame.TransactionID)
+
+	ctx, cancel := context.WithTimeout(ctx, s.requestTimeout)
+	defer cancel()
+	out := s.processTransaction(ctx, transactionCommand(frame.UserID, sourceType, frame.TransactionRequest))
+	span.SetAttribute("http.status_code", out.Code)
+	retryAfter, _ := strconv.Atoi(out.RetryAfter)
+
+	return TransactionAck{
+		Type:          "ack",
+		TransactionID: frame.TransactionID,
+		UserID:        frame.UserID,
+		Code:          out.Code,
+		Status:        out.Status,
+		Error:         out.Error,
+		ErrorCode:     out.ErrorCode,
+		RetryAfter:    retryAfter,
+	}
+}
+
+func writeSocketJSON(conn *websocket.Conn, v any) error {
+	conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+	return conn.WriteJSON(v)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProviderTokens(t *testing.T) {
+	tokens, err := parseProviderTokens("acme=tok-a, beta = tok-b\n# comment\ngamma=tok-c\n")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"tok-a": "acme", "tok-b": "beta", "tok-c": "gamma"}, tokens)
+
+	_, err = parseProviderTokens("acme")
+	assert.ErrorContains(t, err, "expected provider=token")
+	_, err = parseProviderTokens("acme corp=tok")
+	assert.Error(t, err, "providers are source types")
+	_, err = parseProviderTokens("acme=tok,beta=tok")
+	assert.ErrorContains(t, err, "reuses the token")
+}
+
+func TestSocketGateway_AckHistory(t *testing.T) {
+	cfg := DefaultSocketConfig()
+	cfg.AckHistory = 2
+	g := newSocketGateway(cfg)
+	for _, id := range []string{"a", "b", "c"} {
+		g.record("acme", TransactionAck{TransactionID: id})
+	}
+
+	missed, ok := g.acksAfter("acme", "b")
+	assert.True(t, ok)
+	assert.Equal(t, []TransactionAck{{TransactionID: "c"}}, missed)
+
+	_, ok = g.acksAfter("acme", "a")
+	assert.False(t, ok, "trimmed from the history")
+	_, ok = g.acksAfter("beta", "c")
+	assert.False(t, ok, "acks are kept per provider")
+}
+
+func newSocketServer(t *testing.T) *httptest.Server {
+	mem := NewMemoryStore()
+	require.NoError(t, mem.Init(context.Background()))
+	cfg := DefaultSocketConfig()
+	cfg.Tokens = map[string]string{"tok-a": "game"}
+	srv := httptest.NewServer(NewAPIServer(mem, WithTransactionSocket(cfg)).Router())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func dialSocket(t *testing.T, srv *httptest.Server, query string) (*websocket.Conn, socketHello) {
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/transactions/ws" + query
+	header := http.Header{"Authorization": {"Bearer tok-a"}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	var hello socketHello
+	require.NoError(t, conn.ReadJSON(&hello))
+	return conn, hello
+}
+
+func TestHandleTransactionSocket(t *testing.T) {
+	srv := newSocketServer(t)
+	conn, hello := dialSocket(t, srv, "")
+	assert.Equal(t, socketHello{Type: "hello", Provider: "game", Window: 64}, hello)
+
+	frames := []string{
+		`{"userId":1,"state":"win","amount":"10.00","transactionId":"ws-1"}`,
+		`{"userId":1,"state":"lose","amount":"50.00","transactionId":"ws-2"}`,
+		`{"userId":1,"state":"win","amount":"10.00","transactionId":"ws-1"}`,
+		`{"userId":1,"state":"win","amount":"1.001","transactionId":"ws-3"}`,
+		`not json`,
+		`{"userId":1,"state":"win","amount":"1.00","transactionId":"ws-5","currency":"EUR"}`,
+		`{"userId":1,"state":"lose","amount":"4.50","transactionId":"ws-4"}`,
+	}
+	// sent ahead of any ack, within the window
+	for _, f := range frames {
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(f)))
+	}
+
+	want := []TransactionAck{
+		{Type: "ack", TransactionID: "ws-1", UserID: 1, Code: http.StatusOK, Status: "success"},
+		{Type: "ack", TransactionID: "ws-2", UserID: 1, Code: http.StatusBadRequest, Error: ErrInsufficientFunds.Error()},
+		{Type: "ack", TransactionID: "ws-1", UserID: 1, Code: http.StatusOK, Status: "already processed"},
+		{Type: "ack", TransactionID: "ws-3", UserID: 1, Code: http.StatusBadRequest, Error: "Amount must have up to 2 decimal places", ErrorCode: "amount_precision"},
+		{Type: "ack", Code: http.StatusBadRequest, Error: "Invalid JSON frame", ErrorCode: "invalid_json"},
+		{Type: "ack", Code: http.StatusBadRequest, Error: "Invalid JSON frame", ErrorCode: "unknown_field"},
+		{Type: "ack", TransactionID: "ws-4", UserID: 1, Code: http.StatusOK, Status: "success"},
+	}
+	for _, w := range want {
+		var ack TransactionAck
+		require.NoError(t, conn.ReadJSON(&ack))
+		assert.Equal(t, w, ack)
+	}
+
+	resp, err := http.Get(srv.URL + "/user/1/balance")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var balance BalanceResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&balance))
+	assert.Equal(t, "5.50", balance.Balance)
+}
+
+func TestHandleTransactionSocket_Resume(t *testing.T) {
+	srv := newSocketServer(t)
+	conn, _ := dialSocket(t, srv, "")
+	for _, f := range []string{
+		`{"userId":2,"state":"win","amount":"1.00","transactionId":"r-1"}`,
+		`{"userId":2,"state":"win","amount":"2.00","transactionId":"r-2"}`,
+		`{"userId":2,"state":"win","amount":"3.00","transactionId":"r-3"}`,
+	} {
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(f)))
+		var ack TransactionAck
+		require.NoError(t, conn.ReadJSON(&ack))
+	}
+	conn.Close()
+
+	// the provider only saw the ack of r-1 before losing the connection
+	conn, hello := dialSocket(t, srv, "?lastAcked=r-1")
+	assert.True(t, hello.Resumed)
+	for _, id := range []string{"r-2", "r-3"} {
+		var ack TransactionAck
+		require.NoError(t, conn.ReadJSON(&ack))
+		assert.Equal(t, id, ack.TransactionID)
+		assert.Equal(t, "success", ack.Status)
+	}
+
+	_, hello = dialSocket(t, srv, "?lastAcked=unknown")
+	assert.False(t, hello.Resumed)
+}
+
+func TestHandleTransactionSocket_RequiresToken(t *testing.T) {
+	srv := newSocketServer(t)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/transactions/ws"
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer wrong"}, "Source-Type": {"game"}})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// the source comes from the token, it can't be picked per connection
+	_, resp, err = websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer tok-a"}, "Source-Type": {"payment"}})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer tok-a"}, "Source-Type": {"game"}})
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestTransactionSocketDisabledByDefault(t *testing.T) {
+	router := NewAPIServer(NewMockStore()).Router()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/transactions/ws", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqlitePragmas are applied to every pooled connection. _txlock=immediate makes
+// BEGIN take the write lock up front, which replaces SELECT ... FOR UPDATE.
+const sqlitePragmas = "_txlock=immediate&_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+
+// SQLiteStore implements Storage on an SQLite database file, for small
+// deployments and offline demos. Write transactions are serialized, both
+// in-process and across processes, instead of locking single rows.
+type SQLiteStore struct {
+	Db *sql.DB
+
+	// writeMu serializes write transactions of this process so they queue in Go
+	// instead of spinning on SQLITE_BUSY
+	writeMu sync.Mutex
+}
+
+// NewSQLiteStore opens the database at path, which may be a plain file path,
+// a file: URI or :memory:
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", sqliteDSN(path))
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.Contains(path, ":memory:") {
+		// every connection to :memory: is a separate database
+		db.SetMaxOpenConns(1)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{
+		Db: db,
+	}, nil
+}
+
+func sqliteDSN(path string) string {
+	if !strings.HasPrefix(path, "file:") {
+		path = "file:" + path
+	}
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + sqlitePragmas
+}
+
+// Init runs database migrations and seeds predefined users
+func (s *SQLiteStore) Init(ctx context.Context) error {
+	migrator, err := NewMigrator(s.Db, dialectSQLite)
+	if err != nil {
+		return err
+	}
+	s.writeMu.Lock()
+	applied, err := migrator.Up(ctx)
+	s.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, m := range applied {
+		slog.Info("applied migration", "version", m.Version, "name", m.Name)
+	}
+	return s.EnsurePredefinedUsers(ctx)
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.Db.Close()
+}
+
+func (s *SQLiteStore) Ping(ctx context.Context) error {
+	return s.Db.PingContext(ctx)
+}
+
+func (s *SQLiteStore) Stats() sql.DBStats {
+	return s.Db.Stats()
+}
+
+// SchemaVersion reports the latest migration applied to the database
+func (s *SQLiteStore) SchemaVersion(ctx context.Context) (int, error) {
+	var tables int
+	err := s.Db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'").Scan(&tables)
+	if err != nil || tables == 0 {
+		return 0, err
+	}
+	var version int
+	err = s.Db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+func (s *SQLiteStore) CreateTransaction(ctx context.Context, tx Transaction) error {
+	query := `
+	INSERT INTO transactions (transaction_id, user_id, state, amount, source_type, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6)`
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.Db.ExecContext(ctx, query,
+		tx.TransactionID,
+		tx.UserID,
+		tx.State,
+		roundCents(tx.Amount),
+		tx.SourceType,
+		tx.CreatedAt,
+	)
+	return err
+}
+
+func (s *SQLiteStore) GetUserBalance(ctx context.Context, userID uint64) (float64, error) {
+	var balance float64
+	err := s.Db.QueryRowContext(ctx, "SELECT balance FROM users WHERE user_id = $1", userID).Scan(&balance)
+	if err != nil {
+		return 0, err
+	}
+	return balance, nil
+}
+
+func (s *SQLiteStore) GetTransactionByID(ctx context.Context, transactionID string) (*Transaction, error) {
+	query := `
+	SELECT id, transaction_id, user_id, state, amount, source_type, created_at
+	FROM transactions WHERE transaction_id = $1`
+	row := s.Db.QueryRowContext(ctx, query, transactionID)
+
+	var tx Transaction
+	err := row.Scan(
+		&tx.ID,
+		&tx.TransactionID,
+		&tx.UserID,
+		&tx.State,
+		&tx.Amount,
+		&tx.SourceType,
+		&tx.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+func (s *SQLiteStore) ListTransactions(ctx context.Context, userID uint64, beforeID int64, limit int) ([]Transaction, error) {
+	return queryTransactions(ctx, s.Db, userID, beforeID, limit)
+}
+
+func (s *SQLiteStore) ConsumeQuota(ctx context.Context, sourceType string, day time.Time, amount float64, quota QuotaConfig) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return consumeQuota(ctx, s.Db, sourceType, day, amount, quota)
+}
+
+func (s *SQLiteStore) ReleaseQuota(ctx context.Context, sourceType string, day time.Time, amount float64) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return releaseQuota(ctx, s.Db, sourceType, day, amount)
+}
+
+// UpdateUserBalance updates the user's balance by a delta inside a serialized
+// write transaction
+func (s *SQLiteStore) UpdateUserBalance(ctx context.Context, userID uint64, delta float64) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	tx, err := s.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var currentBalance float64
+	err = tx.QueryRowContext(ctx, "SELECT balance FROM users WHERE user_id = $1", userID).Scan(&currentBalance)
+	if err != nil {
+		return err
+	}
+
+	newBalance := amountToCents(currentBalance) + amountToCents(delta)
+	if newBalance < 0 {
+		return ErrInsufficientFunds
+	}
+	if newBalance > maxBalanceCents {
+		return errBalanceOverflow
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET balance = $1, version = version + 1 WHERE user_id = $2", centsToAmount(newBalance), userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ApplyTransaction records the transaction and updates the balance in one
+// serialized write transaction
+func (s *SQLiteStore) ApplyTransaction(ctx context.Context, t Transaction, delta float64) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	tx, err := s.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var currentBalance float64
+	err = tx.QueryRowContext(ctx, "SELECT balance FROM users WHERE user_id = $1", t.UserID).Scan(&currentBalance)
+	if err != nil {
+		return err
+	}
+
+	newBalance := amountToCents(currentBalance) + amountToCents(delta)
+	if newBalance < 0 {
+		return ErrInsufficientFunds
+	}
+	if newBalance > maxBalanceCents {
+		return errBalanceOverflow
+	}
+
+	res, err := tx.ExecContext(ctx, `
+	INSERT INTO transactions (transaction_id, user_id, state, amount, source_type, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (transaction_id) DO NOTHING`,
+		t.TransactionID,
+		t.UserID,
+		t.State,
+		roundCents(t.Amount),
+		t.SourceType,
+		t.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrDuplicateTransaction
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET balance = $1, version = version + 1 WHERE user_id = $2", centsToAmount(newBalance), t.UserID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) EnsurePredefinedUsers(ctx context.Context) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	for _, id := range []uint64{1, 2, 3} {
+		_, err := s.Db.ExecContext(ctx, `
+			INSERT INTO users (user_id, balance)
+			VALUES ($1, 0)
+			ON CONFLICT (user_id) DO NOTHING
+		`, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
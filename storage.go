@@ -1,92 +1,337 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	_ "github.com/lib/pq"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrInsufficientFunds is returned when a delta would make the balance negative
+var ErrInsufficientFunds = errors.New("balance cannot be negative")
+
+// ErrDuplicateTransaction is returned by ApplyTransaction for an already recorded transaction ID
+var ErrDuplicateTransaction = errors.New("transaction already processed")
+
+// ErrConcurrentUpdate is returned when an optimistic balance update keeps
+// losing the race against concurrent writers of the same user
+var ErrConcurrentUpdate = errors.New("balance was updated concurrently")
+
+// errVersionConflict means the user row changed between reading and updating it
+var errVersionConflict = errors.New("user version changed")
+
+// Balance update strategies of PostgresStore
+const (
+	// lockingPessimistic locks the user row with SELECT ... FOR UPDATE
+	lockingPessimistic = "pessimistic"
+	// lockingOptimistic reads without locking and updates with a compare-and-swap on users.version
+	lockingOptimistic = "optimistic"
+	// lockingConditional applies the delta and records the transaction in one
+	// statement, saving the round trips of reading the balance first
+	lockingConditional = "conditional"
 )
 
 type Storage interface {
-	CreateTransaction(tx Transaction) error
-	GetUserBalance(userID uint64) (float64, error)
-	GetTransactionByID(transactionID string) (*Transaction, error)
-	UpdateUserBalance(userID uint64, delta float64) error
-	EnsurePredefinedUsers() error
-	Init() error
+	CreateTransaction(ctx context.Context, tx Transaction) error
+	GetUserBalance(ctx context.Context, userID uint64) (float64, error)
+	GetTransactionByID(ctx context.Context, transactionID string) (*Transaction, error)
+	// ListTransactions returns up to limit transactions of the user, newest
+	// first, starting below the ID beforeID when it isn't 0
+	ListTransactions(ctx context.Context, userID uint64, beforeID int64, limit int) ([]Transaction, error)
+	UpdateUserBalance(ctx context.Context, userID uint64, delta float64) error
+	// ApplyTransaction records tx and applies delta to the user's balance as one
+	// atomic, idempotent unit
+	ApplyTransaction(ctx context.Context, tx Transaction, delta float64) error
+	// ConsumeQuota counts one transaction of amount against the usage of
+	// sourceType on the UTC day of day, or returns ErrQuotaExceeded and counts
+	// nothing when that would go over quota
+	ConsumeQuota(ctx context.Context, sourceType string, day time.Time, amount float64, quota QuotaConfig) error
+	// ReleaseQuota takes back what ConsumeQuota counted for a transaction
+	// that was not applied
+	ReleaseQuota(ctx context.Context, sourceType string, day time.Time, amount float64) error
+	EnsurePredefinedUsers(ctx context.Context) error
+	Init(ctx context.Context) error
 	Close() error
 }
 
 type PostgresStore struct {
 	Db *sql.DB
+
+	// replica serves balance reads when configured, nil reads from Db
+	replica *replicaReader
+
+	// retry is applied to reads and to ApplyTransaction, the zero value disables it
+	retry RetryPolicy
+
+	// locking selects the balance update strategy, empty means pessimistic.
+	// casRetry bounds the attempts of the optimistic one.
+	locking  string
+	casRetry RetryPolicy
+
+	// outbox writes a balance change event with every mutation, see OutboxRelay
+	outbox bool
+
+	// notify announces every balance change on balanceChannel, see ListenBalanceChanges
+	notify bool
 }
 
-func NewPostgresStore(host string, port int, user, password, dbname string) (*PostgresStore, error) {
-	connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
-	db, err := sql.Open("postgres", connStr)
+// PostgresConfig describes how to reach Postgres and how to size the pool
+type PostgresConfig struct {
+	// DSN is a postgres:// URL or keyword/value string. When set it replaces
+	// Host, Port, User, Password and DBName; the options below still apply.
+	DSN      string
+	Host     string
+	Port     int
+	User     string
+	Password string
+	DBName   string
+
+	// PasswordFile holds the password, e.g. a Docker secret, and wins over
+	// both Password and a password in the DSN
+	PasswordFile string
+
+	// SSLMode and SSLRootCert override the DSN; SSLMode defaults to disable
+	// when no DSN is given
+	SSLMode     string
+	SSLRootCert string
+
+	// StatementTimeout and LockTimeout are set as session parameters, 0 keeps the server default
+	StatementTimeout time.Duration
+	LockTimeout      time.Duration
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// ReplicaDSN points at a streaming replica used for reads that don't need
+	// to see the latest writes. The options above apply to it as well.
+	ReplicaDSN string
+	// MaxReplicaLag sends reads back to the primary while the replica is further behind
+	MaxReplicaLag time.Duration
+
+	// Locking is the balance update strategy: pessimistic, optimistic or conditional.
+	// CASRetry bounds how often an optimistic update retries a lost race.
+	Locking  string
+	CASRetry RetryPolicy
+
+	// Outbox records a balance change event in the outbox table with every
+	// mutation, for an OutboxRelay to publish
+	Outbox bool
+
+	// Notify sends a NOTIFY with every balance change, feeding balance streams
+	Notify bool
+
+	// ConnectRetry waits for the database on startup, TxRetry retries
+	// transaction units that fail with transient errors while running
+	ConnectRetry RetryPolicy
+	TxRetry      RetryPolicy
+}
+
+func DefaultPostgresConfig() PostgresConfig {
+	return PostgresConfig{
+		Host:          "db",
+		Port:          5432,
+		MaxOpenConns:  20,
+		MaxIdleConns:  5,
+		MaxReplicaLag: defaultMaxReplicaLag,
+		Locking:       lockingPessimistic,
+		CASRetry:      defaultCASRetry,
+		ConnectRetry:  defaultConnectRetry,
+		TxRetry:       defaultTxRetry,
+	}
+}
+
+// ConnString renders the config as a lib/pq keyword/value connection string.
+// Later keys win in that format, so overrides are appended to the base DSN.
+func (c PostgresConfig) ConnString() (string, error) {
+	var base string
+	switch {
+	case strings.HasPrefix(c.DSN, "postgres://"), strings.HasPrefix(c.DSN, "postgresql://"):
+		converted, err := pq.ParseURL(c.DSN)
+		if err != nil {
+			return "", fmt.Errorf("invalid database URL: %s", redactDSN(err.Error()))
+		}
+		base = converted
+	case c.DSN != "":
+		base = c.DSN
+	default:
+		base = fmt.Sprintf("host=%s port=%d user=%s dbname=%s",
+			quoteDSNValue(c.Host), c.Port, quoteDSNValue(c.User), quoteDSNValue(c.DBName))
+	}
+
+	params := []string{base}
+	password := ""
+	if c.DSN == "" {
+		password = c.Password
+	}
+	if c.PasswordFile != "" {
+		data, err := os.ReadFile(c.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("reading password file: %w", err)
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+	if password != "" {
+		params = append(params, "password="+quoteDSNValue(password))
+	}
+	sslMode := c.SSLMode
+	if sslMode == "" && c.DSN == "" {
+		sslMode = "disable"
+	}
+	if sslMode != "" {
+		params = append(params, "sslmode="+quoteDSNValue(sslMode))
+	}
+	if c.SSLRootCert != "" {
+		params = append(params, "sslrootcert="+quoteDSNValue(c.SSLRootCert))
+	}
+	// unknown keys are sent to the server as session parameters
+	if c.StatementTimeout > 0 {
+		params = append(params, fmt.Sprintf("statement_timeout=%d", c.StatementTimeout.Milliseconds()))
+	}
+	if c.LockTimeout > 0 {
+		params = append(params, fmt.Sprintf("lock_timeout=%d", c.LockTimeout.Milliseconds()))
+	}
+	return strings.Join(params, " "), nil
+}
+
+var dsnValueEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// quoteDSNValue quotes a keyword/value connection string value when needed
+func quoteDSNValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, ` '\`) {
+		return v
+	}
+	return "'" + dsnValueEscaper.Replace(v) + "'"
+}
+
+func NewPostgresStore(cfg PostgresConfig) (*PostgresStore, error) {
+	switch cfg.Locking {
+	case "", lockingPessimistic, lockingOptimistic, lockingConditional:
+	default:
+		return nil, fmt.Errorf("unknown locking strategy %q, expected %s, %s or %s",
+			cfg.Locking, lockingPessimistic, lockingOptimistic, lockingConditional)
+	}
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = retryTransient(context.Background(), cfg.ConnectRetry, func() error {
+		return db.Ping()
+	})
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	db.SetMaxOpenConns(20)
-	db.SetMaxIdleConns(5)
+	store := &PostgresStore{
+		Db:       db,
+		retry:    cfg.TxRetry,
+		locking:  cfg.Locking,
+		casRetry: cfg.CASRetry,
+		outbox:   cfg.Outbox,
+		notify:   cfg.Notify,
+	}
+
+	if cfg.ReplicaDSN != "" {
+		replicaCfg := cfg
+		replicaCfg.DSN = cfg.ReplicaDSN
+		replica, err := openPostgres(replicaCfg)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		// reads fall back to the primary while the replica is down, so it
+		// doesn't have to be up to start
+		if err := replica.Ping(); err != nil {
+			slog.Warn("replica is not reachable, reading from primary until it is", "error", err)
+		}
+		store.replica = newReplicaReader(replica, cfg.MaxReplicaLag)
+	}
+
+	return store, nil
+}
 
-	if err := db.Ping(); err != nil {
+func openPostgres(cfg PostgresConfig) (*sql.DB, error) {
+	connStr, err := cfg.ConnString()
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("connecting to database", "dsn", redactDSN(connStr))
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
 		return nil, err
 	}
 
-	return &PostgresStore{
-		Db: db,
-	}, nil
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+	return db, nil
+}
+
+// reader returns the pool a read should use: the replica unless the request
+// asked for strong consistency or the replica lags behind
+func (s *PostgresStore) reader(ctx context.Context) *sql.DB {
+	if s.replica == nil || strongConsistency(ctx) || !s.replica.usable(ctx) {
+		return s.Db
+	}
+	return s.replica.db
 }
 
 // Init runs database migrations and seeds predefined users
-func (s *PostgresStore) Init() error {
-	if err := s.createUsersTable(); err != nil {
+func (s *PostgresStore) Init(ctx context.Context) error {
+	migrator, err := NewMigrator(s.Db, dialectPostgres)
+	if err != nil {
 		return err
 	}
-	if err := s.createTransactionsTable(); err != nil {
+	applied, err := migrator.Up(ctx)
+	if err != nil {
 		return err
 	}
-	return s.EnsurePredefinedUsers()
+	for _, m := range applied {
+		slog.Info("applied migration", "version", m.Version, "name", m.Name)
+	}
+	return s.EnsurePredefinedUsers(ctx)
 }
 
 func (s *PostgresStore) Close() error {
+	if s.replica != nil {
+		s.replica.db.Close()
+	}
 	return s.Db.Close()
 }
 
-func (s *PostgresStore) createUsersTable() error {
-	query := `
-	CREATE TABLE IF NOT EXISTS users (
-		user_id BIGSERIAL PRIMARY KEY,
-		balance NUMERIC(12, 2) NOT NULL DEFAULT 0,
-		created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT NOW()
-	);`
-	_, err := s.Db.Exec(query)
-	return err
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	return s.Db.PingContext(ctx)
 }
 
-func (s *PostgresStore) createTransactionsTable() error {
-	query := `
-	CREATE TABLE IF NOT EXISTS transactions (
-		id BIGSERIAL PRIMARY KEY,
-		transaction_id VARCHAR(255) UNIQUE NOT NULL,
-		user_id BIGINT NOT NULL,
-		state VARCHAR(10) NOT NULL,   -- "win" or "lose"
-		amount NUMERIC(12, 2) NOT NULL,
-		source_type VARCHAR(50) NOT NULL,   -- "game", "server", "payment", etc.
-		created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT NOW(),
-		FOREIGN KEY (user_id) REFERENCES users(user_id)
-	);`
-	_, err := s.Db.Exec(query)
-	return err
+func (s *PostgresStore) Stats() sql.DBStats {
+	return s.Db.Stats()
 }
 
-func (s *PostgresStore) CreateTransaction(tx Transaction) error {
+// SchemaVersion reports the latest migration applied to the database
+func (s *PostgresStore) SchemaVersion(ctx context.Context) (int, error) {
+	var version int
+	err := s.Db.QueryRowContext(ctx, `
+		SELECT CASE WHEN to_regclass('public.schema_migrations') IS NULL THEN 0
+		       ELSE (SELECT COALESCE(MAX(version), 0) FROM schema_migrations) END`).Scan(&version)
+	return version, err
+}
+
+func (s *PostgresStore) CreateTransaction(ctx context.Context, tx Transaction) error {
 	query := `
 	INSERT INTO transactions (transaction_id, user_id, state, amount, source_type, created_at)
 	VALUES ($1, $2, $3, $4, $5, $6)`
-	_, err := s.Db.Exec(query,
+	_, err := s.Db.ExecContext(ctx, query,
 		tx.TransactionID,
 		tx.UserID,
 		tx.State,
@@ -97,68 +342,351 @@ func (s *PostgresStore) CreateTransaction(tx Transaction) error {
 	return err
 }
 
-func (s *PostgresStore) GetUserBalance(userID uint64) (float64, error) {
+func (s *PostgresStore) GetUserBalance(ctx context.Context, userID uint64) (float64, error) {
 	var balance float64
-	err := s.Db.QueryRow("SELECT balance FROM users WHERE user_id = $1", userID).Scan(&balance)
+	err := retryTransient(ctx, s.retry, func() error {
+		return s.reader(ctx).QueryRowContext(ctx, "SELECT balance FROM users WHERE user_id = $1", userID).Scan(&balance)
+	})
 	if err != nil {
 		return 0, err
 	}
 	return balance, nil
 }
 
-func (s *PostgresStore) GetTransactionByID(transactionID string) (*Transaction, error) {
+// GetTransactionByID always reads from the primary, it backs the idempotency
+// check and must see transactions committed a moment ago
+func (s *PostgresStore) GetTransactionByID(ctx context.Context, transactionID string) (*Transaction, error) {
 	query := `
 	SELECT id, transaction_id, user_id, state, amount, source_type, created_at
 	FROM transactions WHERE transaction_id = $1`
-	row := s.Db.QueryRow(query, transactionID)
 
 	var tx Transaction
-	err := row.Scan(
-		&tx.ID,
-		&tx.TransactionID,
-		&tx.UserID,
-		&tx.State,
-		&tx.Amount,
-		&tx.SourceType,
-		&tx.CreatedAt,
-	)
+	err := retryTransient(ctx, s.retry, func() error {
+		return s.Db.QueryRowContext(ctx, query, transactionID).Scan(
+			&tx.ID,
+			&tx.TransactionID,
+			&tx.UserID,
+			&tx.State,
+			&tx.Amount,
+			&tx.SourceType,
+			&tx.CreatedAt,
+		)
+	})
 	if err != nil {
 		return nil, err
 	}
 	return &tx, nil
 }
 
+func (s *PostgresStore) ListTransactions(ctx context.Context, userID uint64, beforeID int64, limit int) ([]Transaction, error) {
+	var txs []Transaction
+	err := retryTransient(ctx, s.retry, func() error {
+		var err error
+		txs, err = queryTransactions(ctx, s.reader(ctx), userID, beforeID, limit)
+		return err
+	})
+	return txs, err
+}
+
+// queryTransactions pages through a user's transactions, shared by the SQL stores
+func queryTransactions(ctx context.Context, db *sql.DB, userID uint64, beforeID int64, limit int) ([]Transaction, error) {
+	rows, err := db.QueryContext(ctx, `
+	SELECT id, transaction_id, user_id, state, amount, source_type, created_at
+	FROM transactions WHERE user_id = $1 AND ($2 = 0 OR id < $2)
+	ORDER BY id DESC LIMIT $3`, userID, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	txs := []Transaction{}
+	for rows.Next() {
+		var tx Transaction
+		if err := rows.Scan(&tx.ID, &tx.TransactionID, &tx.UserID, &tx.State, &tx.Amount, &tx.SourceType, &tx.CreatedAt); err != nil {
+			return nil, err
+		}
+		txs = append(txs, tx)
+	}
+	return txs, rows.Err()
+}
+
+// ConsumeQuota is not retried, an attempt failing after its commit would count twice
+func (s *PostgresStore) ConsumeQuota(ctx context.Context, sourceType string, day time.Time, amount float64, quota QuotaConfig) error {
+	return consumeQuota(ctx, s.Db, sourceType, day, amount, quota)
+}
+
+func (s *PostgresStore) ReleaseQuota(ctx context.Context, sourceType string, day time.Time, amount float64) error {
+	return releaseQuota(ctx, s.Db, sourceType, day, amount)
+}
+
+// consumeQuota bumps the day's usage in one statement, shared by the SQL
+// stores. The conditional upsert leaves the row alone when over quota.
+func consumeQuota(ctx context.Context, db *sql.DB, sourceType string, day time.Time, amount float64, quota QuotaConfig) error {
+	cents := amountToCents(amount)
+	if quotaExceededBy(quota, 1, cents) {
+		return ErrQuotaExceeded
+	}
+	res, err := db.ExecContext(ctx, `
+	INSERT INTO source_quotas (source_type, day, tx_count, amount_cents) VALUES ($1, $2, 1, $3)
+	ON CONFLICT (source_type, day) DO UPDATE
+	SET tx_count = source_quotas.tx_count + 1, amount_cents = source_quotas.amount_cents + excluded.amount_cents
+	WHERE (CAST($4 AS BIGINT) = 0 OR source_quotas.tx_count < CAST($4 AS BIGINT))
+	AND (CAST($5 AS BIGINT) = 0 OR source_quotas.amount_cents + excluded.amount_cents <= CAST($5 AS BIGINT))`,
+		sourceType, day.UTC().Format(time.DateOnly), cents, quota.DailyCount, amountToCents(quota.DailyAmount))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+func releaseQuota(ctx context.Context, db *sql.DB, sourceType string, day time.Time, amount float64) error {
+	_, err := db.ExecContext(ctx, `
+	UPDATE source_quotas SET tx_count = tx_count - 1, amount_cents = amount_cents - $3
+	WHERE source_type = $1 AND day = $2 AND tx_count > 0`,
+		sourceType, day.UTC().Format(time.DateOnly), amountToCents(amount))
+	return err
+}
+
 // UpdateUserBalance updates the user's balance by a delta
-func (s *PostgresStore) UpdateUserBalance(userID uint64, delta float64) error {
-	tx, err := s.Db.Begin()
+func (s *PostgresStore) UpdateUserBalance(ctx context.Context, userID uint64, delta float64) error {
+	return s.updateBalance(ctx, userID, delta, nil)
+}
+
+// ApplyTransaction locks the user row, records the transaction and updates the
+// balance in one database transaction. The unit is idempotent thanks to the
+// unique transaction ID, so it is retried as a whole on transient errors.
+func (s *PostgresStore) ApplyTransaction(ctx context.Context, t Transaction, delta float64) error {
+	return retryTransient(ctx, s.retry, func() error {
+		return s.updateBalance(ctx, t.UserID, delta, &t)
+	})
+}
+
+// updateBalance applies delta to the user's balance with the configured
+// strategy, recording t, when given, in the same database transaction
+func (s *PostgresStore) updateBalance(ctx context.Context, userID uint64, delta float64, t *Transaction) error {
+	switch s.locking {
+	case lockingConditional:
+		return s.updateBalanceConditional(ctx, userID, delta, t)
+	case lockingOptimistic:
+		err := retryIf(ctx, s.casRetry, func(err error) bool {
+			return errors.Is(err, errVersionConflict)
+		}, func(attempt int, delay time.Duration, err error) {
+			slog.DebugContext(ctx, "optimistic balance update lost a race", "user_id", userID, "attempt", attempt)
+		}, func() error {
+			return s.updateBalanceOptimistic(ctx, userID, delta, t)
+		})
+		if errors.Is(err, errVersionConflict) {
+			return ErrConcurrentUpdate
+		}
+		return err
+	default:
+		return s.updateBalancePessimistic(ctx, userID, delta, t)
+	}
+}
+
+func (s *PostgresStore) updateBalancePessimistic(ctx context.Context, userID uint64, delta float64, t *Transaction) error {
+	tx, err := s.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the user row first, inserting the transaction takes a key share lock
+	// on it and upgrading afterwards could deadlock with concurrent requests
+	var currentBalance float64
+	err = tx.QueryRowContext(ctx, "SELECT balance FROM users WHERE user_id = $1 FOR UPDATE", userID).Scan(&currentBalance)
+	if err != nil {
+		return err
+	}
+
+	newBalance := currentBalance + delta
+	if newBalance < 0 {
+		return ErrInsufficientFunds
+	}
+
+	if t != nil {
+		if err := insertTransaction(ctx, tx, *t); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET balance = $1, version = version + 1 WHERE user_id = $2", newBalance, userID)
+	if err != nil {
+		return err
+	}
+
+	if s.outbox {
+		if err := insertOutboxEvent(ctx, tx, userID, t, delta, newBalance); err != nil {
+			return err
+		}
+	}
+
+	if s.notify {
+		if err := notifyBalanceChange(ctx, tx, userID, t, delta); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// updateBalanceOptimistic reads the balance without locking and only writes
+// it back if no one else updated the user in between
+func (s *PostgresStore) updateBalanceOptimistic(ctx context.Context, userID uint64, delta float64, t *Transaction) error {
+	tx, err := s.Db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	// Lock the user row for update
 	var currentBalance float64
-	err = tx.QueryRow("SELECT balance FROM users WHERE user_id = $1 FOR UPDATE", userID).Scan(&currentBalance)
+	var version int64
+	err = tx.QueryRowContext(ctx, "SELECT balance, version FROM users WHERE user_id = $1", userID).Scan(&currentBalance, &version)
 	if err != nil {
 		return err
 	}
 
 	newBalance := currentBalance + delta
 	if newBalance < 0 {
-		return fmt.Errorf("balance cannot be negative")
+		return ErrInsufficientFunds
+	}
+
+	if t != nil {
+		if err := insertTransaction(ctx, tx, *t); err != nil {
+			return err
+		}
 	}
 
-	_, err = tx.Exec("UPDATE users SET balance = $1 WHERE user_id = $2", newBalance, userID)
+	res, err := tx.ExecContext(ctx,
+		"UPDATE users SET balance = $1, version = version + 1 WHERE user_id = $2 AND version = $3",
+		newBalance, userID, version)
 	if err != nil {
 		return err
 	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errVersionConflict
+	}
+
+	if s.outbox {
+		if err := insertOutboxEvent(ctx, tx, userID, t, delta, newBalance); err != nil {
+			return err
+		}
+	}
+
+	if s.notify {
+		if err := notifyBalanceChange(ctx, tx, userID, t, delta); err != nil {
+			return err
+		}
+	}
 
 	return tx.Commit()
 }
 
-func (s *PostgresStore) EnsurePredefinedUsers() error {
+// conditionalQuery builds the statement of the conditional strategy. It
+// applies $2 to user $1 unless the balance would go negative, and only then
+// records the transaction ($3 to $7) and the outbox event. A duplicate
+// transaction ID fails the insert and with it the whole statement, update
+// included. The second column tells a missing user from insufficient funds.
+func conditionalQuery(record, outbox, notify bool) string {
+	var b strings.Builder
+	b.WriteString(`
+	WITH upd AS (
+		UPDATE users SET balance = balance + $2, version = version + 1
+		WHERE user_id = $1 AND balance + $2 >= 0
+		RETURNING balance, version
+	)`)
+	transactionID := "NULL"
+	if record {
+		// INSERT ... SELECT doesn't infer parameter types from the columns
+		b.WriteString(`, ins AS (
+		INSERT INTO transactions (transaction_id, user_id, state, amount, source_type, created_at)
+		SELECT $3::varchar, $1, $4::varchar, $5::numeric, $6::varchar, $7::timestamp FROM upd
+		RETURNING id
+	)`)
+		transactionID = "$3::varchar"
+	}
+	if outbox {
+		b.WriteString(`, evt AS (
+		INSERT INTO outbox (user_id, transaction_id, delta, balance)
+		SELECT $1, ` + transactionID + `, $2, balance FROM upd
+	)`)
+	}
+	if notify {
+		// a plain SELECT in a WITH only runs when referenced, hence the FROM below
+		b.WriteString(`, ntf AS (
+		SELECT pg_notify('` + balanceChannel + `', json_build_object('userId', $1::bigint, 'transactionId', ` + transactionID + `,
+			'delta', $2::numeric, 'balance', balance, 'version', version)::text) FROM upd
+	)`)
+	}
+	b.WriteString(`
+	SELECT (SELECT balance FROM upd), EXISTS (SELECT 1 FROM users WHERE user_id = $1)`)
+	if notify {
+		b.WriteString(` FROM (SELECT count(*) FROM ntf) notified`)
+	}
+	return b.String()
+}
+
+// updateBalanceConditional applies the delta in a single round trip, relying
+// on the statement being atomic on its own
+func (s *PostgresStore) updateBalanceConditional(ctx context.Context, userID uint64, delta float64, t *Transaction) error {
+	args := []any{userID, delta}
+	if t != nil {
+		args = append(args, t.TransactionID, t.State, t.Amount, t.SourceType, t.CreatedAt)
+	}
+
+	var newBalance sql.NullFloat64
+	var userExists bool
+	err := s.Db.QueryRowContext(ctx, conditionalQuery(t != nil, s.outbox, s.notify), args...).Scan(&newBalance, &userExists)
+
+	var pqErr *pq.Error
+	switch {
+	case errors.As(err, &pqErr) && pqErr.Code == "23505":
+		// unique_violation, the only unique key written is transaction_id
+		return ErrDuplicateTransaction
+	case err != nil:
+		return err
+	case !userExists:
+		return sql.ErrNoRows
+	case !newBalance.Valid:
+		return ErrInsufficientFunds
+	}
+	return nil
+}
+
+// insertTransaction records t, returning ErrDuplicateTransaction when its ID is taken
+func insertTransaction(ctx context.Context, tx *sql.Tx, t Transaction) error {
+	res, err := tx.ExecContext(ctx, `
+	INSERT INTO transactions (transaction_id, user_id, state, amount, source_type, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (transaction_id) DO NOTHING`,
+		t.TransactionID,
+		t.UserID,
+		t.State,
+		t.Amount,
+		t.SourceType,
+		t.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrDuplicateTransaction
+	}
+	return nil
+}
+
+func (s *PostgresStore) EnsurePredefinedUsers(ctx context.Context) error {
 	for _, id := range []uint64{1, 2, 3} {
-		_, err := s.Db.Exec(`
+		_, err := s.Db.ExecContext(ctx, `
 			INSERT INTO users (user_id, balance)
 			VALUES ($1, 0)
 			ON CONFLICT (user_id) DO NOTHING
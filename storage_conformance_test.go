@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// storageFactory returns a freshly initialized, empty store for one test
+type storageFactory func(t *testing.T) Storage
+
+// storageBackends lists every Storage implementation the conformance suite runs against
+func storageBackends() map[string]storageFactory {
+	return map[string]storageFactory{
+		"memory": func(t *testing.T) Storage {
+			store := NewMemoryStore()
+			require.NoError(t, store.Init(context.Background()))
+			return store
+		},
+		"sqlite": func(t *testing.T) Storage {
+			store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "balance.db"))
+			require.NoError(t, err)
+			t.Cleanup(func() { store.Close() })
+			require.NoError(t, store.Init(context.Background()))
+			return store
+		},
+		"postgres": newTestPostgresStore,
+		"postgres_optimistic": func(t *testing.T) Storage {
+			return openTestPostgres(t, lockingOptimistic)
+		},
+		"postgres_conditional": func(t *testing.T) Storage {
+			return openTestPostgres(t, lockingConditional)
+		},
+	}
+}
+
+// newTestPostgresStore connects to TEST_DATABASE_URL, skipping when it isn't set
+func newTestPostgresStore(t *testing.T) Storage {
+	return openTestPostgres(t, lockingPessimistic)
+}
+
+func openTestPostgres(tb testing.TB, locking string) *PostgresStore {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		tb.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	require.NoError(tb, err)
+	store := &PostgresStore{Db: db, locking: locking, casRetry: defaultCASRetry}
+	tb.Cleanup(func() { store.Close() })
+
+	ctx := context.Background()
+	require.NoError(tb, store.Init(ctx))
+	_, err = db.ExecContext(ctx, "TRUNCATE transactions, users, source_quotas")
+	require.NoError(tb, err)
+	require.NoError(tb, store.EnsurePredefinedUsers(ctx))
+	return store
+}
+
+func TestStorageConformance(t *testing.T) {
+	for name, factory := range storageBackends() {
+		factory := factory
+		t.Run(name, func(t *testing.T) {
+			runStorageConformance(t, factory)
+		})
+	}
+}
+
+func runStorageConformance(t *testing.T, newStore storageFactory) {
+	ctx := context.Background()
+
+	t.Run("PredefinedUsersStartAtZero", func(t *testing.T) {
+		store := newStore(t)
+		for _, id := range []uint64{1, 2, 3} {
+			balance, err := store.GetUserBalance(ctx, id)
+			assert.NoError(t, err)
+			assert.Equal(t, 0.0, balance)
+		}
+		assert.NoError(t, store.EnsurePredefinedUsers(ctx), "seeding must be idempotent")
+	})
+
+	t.Run("UnknownUser", func(t *testing.T) {
+		store := newStore(t)
+		_, err := store.GetUserBalance(ctx, 999)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		assert.Error(t, store.UpdateUserBalance(ctx, 999, 1))
+		assert.Error(t, store.CreateTransaction(ctx, Transaction{
+			TransactionID: "txn-unknown-user", UserID: 999, State: "win", Amount: 1, SourceType: "game", CreatedAt: timeNowUTC(),
+		}))
+	})
+
+	t.Run("BalanceUpdatesRoundToCents", func(t *testing.T) {
+		store := newStore(t)
+		assert.NoError(t, store.UpdateUserBalance(ctx, 1, 10.15))
+		assert.NoError(t, store.UpdateUserBalance(ctx, 1, -1.15))
+		balance, err := store.GetUserBalance(ctx, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 9.0, balance)
+	})
+
+	t.Run("BalanceCannotGoNegative", func(t *testing.T) {
+		store := newStore(t)
+		assert.NoError(t, store.UpdateUserBalance(ctx, 2, 5))
+		err := store.UpdateUserBalance(ctx, 2, -5.01)
+		assert.ErrorIs(t, err, ErrInsufficientFunds)
+		balance, err := store.GetUserBalance(ctx, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, 5.0, balance)
+		assert.NoError(t, store.UpdateUserBalance(ctx, 2, -5))
+	})
+
+	t.Run("TransactionsAreUnique", func(t *testing.T) {
+		store := newStore(t)
+		tx := Transaction{TransactionID: "txn-unique", UserID: 1, State: "win", Amount: 10.15, SourceType: "game", CreatedAt: timeNowUTC()}
+		assert.NoError(t, store.CreateTransaction(ctx, tx))
+		assert.Error(t, store.CreateTransaction(ctx, tx))
+
+		got, err := store.GetTransactionByID(ctx, "txn-unique")
+		assert.NoError(t, err)
+		assert.NotZero(t, got.ID)
+		assert.Equal(t, uint64(1), got.UserID)
+		assert.Equal(t, "win", got.State)
+		assert.Equal(t, 10.15, got.Amount)
+		assert.Equal(t, "game", got.SourceType)
+
+		_, err = store.GetTransactionByID(ctx, "txn-missing")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("ListTransactionsPagesNewestFirst", func(t *testing.T) {
+		store := newStore(t)
+		for i := 1; i <= 5; i++ {
+			assert.NoError(t, store.CreateTransaction(ctx, Transaction{
+				TransactionID: fmt.Sprint("txn-list-", i), UserID: 1, State: "win", Amount: float64(i), SourceType: "game", CreatedAt: timeNowUTC(),
+			}))
+		}
+		assert.NoError(t, store.CreateTransaction(ctx, Transaction{
+			TransactionID: "txn-list-other", UserID: 2, State: "win", Amount: 1, SourceType: "game", CreatedAt: timeNowUTC(),
+		}))
+
+		page, err := store.ListTransactions(ctx, 1, 0, 3)
+		assert.NoError(t, err)
+		require.Len(t, page, 3)
+		assert.Equal(t, "txn-list-5", page[0].TransactionID)
+		assert.Equal(t, "txn-list-3", page[2].TransactionID)
+		assert.Equal(t, 5.0, page[0].Amount)
+
+		page, err = store.ListTransactions(ctx, 1, page[2].ID, 3)
+		assert.NoError(t, err)
+		require.Len(t, page, 2)
+		assert.Equal(t, "txn-list-2", page[0].TransactionID)
+		assert.Equal(t, "txn-list-1", page[1].TransactionID)
+
+		page, err = store.ListTransactions(ctx, 3, 0, 3)
+		assert.NoError(t, err)
+		assert.NotNil(t, page)
+		assert.Empty(t, page)
+	})
+
+	t.Run("DailyQuotasCountPerSourceAndDay", func(t *testing.T) {
+		store := newStore(t)
+		quota := QuotaConfig{DailyCount: 2, DailyAmount: 10}
+		day := time.Date(2026, time.October, 18, 23, 59, 0, 0, time.UTC)
+
+		require.NoError(t, store.ConsumeQuota(ctx, "game", day, 4.5, quota))
+		assert.ErrorIs(t, store.ConsumeQuota(ctx, "game", day, 5.51, quota), ErrQuotaExceeded, "over the amount")
+		require.NoError(t, store.ConsumeQuota(ctx, "game", day, 5.5, quota))
+		assert.ErrorIs(t, store.ConsumeQuota(ctx, "game", day, 0.01, quota), ErrQuotaExceeded, "over the count")
+
+		// other sources and the next day start afresh
+		assert.NoError(t, store.ConsumeQuota(ctx, "payment", day, 1, quota))
+		assert.NoError(t, store.ConsumeQuota(ctx, "game", day.Add(time.Minute), 1, quota))
+		assert.ErrorIs(t, store.ConsumeQuota(ctx, "game", day, 11, QuotaConfig{DailyAmount: 10}), ErrQuotaExceeded, "a single transaction over the amount")
+
+		require.NoError(t, store.ReleaseQuota(ctx, "game", day, 5.5))
+		assert.NoError(t, store.ConsumeQuota(ctx, "game", day, 5.5, quota), "a released transaction frees its share")
+		assert.NoError(t, store.ConsumeQuota(ctx, "game", day, 100, QuotaConfig{}), "no quota")
+	})
+
+	t.Run("ConcurrentUpdatesAreSerialized", func(t *testing.T) {
+		store := newStore(t)
+		assert.NoError(t, store.UpdateUserBalance(ctx, 3, 10))
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		rejected := 0
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := store.UpdateUserBalance(ctx, 3, -1); err != nil {
+					mu.Lock()
+					rejected++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		balance, err := store.GetUserBalance(ctx, 3)
+		assert.NoError(t, err)
+		assert.Equal(t, 0.0, balance)
+		assert.Equal(t, 10, rejected)
+	})
+
+	t.Run("ConcurrentDuplicateTransactions", func(t *testing.T) {
+		store := newStore(t)
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		created := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				err := store.CreateTransaction(ctx, Transaction{
+					TransactionID: "txn-race", UserID: 1, State: "win", Amount: float64(i), SourceType: fmt.Sprint("src", i), CreatedAt: timeNowUTC(),
+				})
+				if err == nil {
+					mu.Lock()
+					created++
+					mu.Unlock()
+				}
+			}(i)
+		}
+		wg.Wait()
+		assert.Equal(t, 1, created)
+	})
+
+	t.Run("ApplyTransactionIsAtomicAndIdempotent", func(t *testing.T) {
+		store := newStore(t)
+		tx := Transaction{TransactionID: "txn-apply", UserID: 1, State: "win", Amount: 10.15, SourceType: "game", CreatedAt: timeNowUTC()}
+		assert.NoError(t, store.ApplyTransaction(ctx, tx, 10.15))
+		assert.ErrorIs(t, store.ApplyTransaction(ctx, tx, 10.15), ErrDuplicateTransaction)
+
+		balance, err := store.GetUserBalance(ctx, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 10.15, balance)
+
+		rejected := Transaction{TransactionID: "txn-apply-rejected", UserID: 1, State: "lose", Amount: 20, SourceType: "game", CreatedAt: timeNowUTC()}
+		assert.ErrorIs(t, store.ApplyTransaction(ctx, rejected, -20), ErrInsufficientFunds)
+		_, err = store.GetTransactionByID(ctx, rejected.TransactionID)
+		assert.ErrorIs(t, err, sql.ErrNoRows, "a rejected transaction must not be recorded")
+
+		unknown := Transaction{TransactionID: "txn-apply-unknown", UserID: 999, State: "win", Amount: 1, SourceType: "game", CreatedAt: timeNowUTC()}
+		assert.ErrorIs(t, store.ApplyTransaction(ctx, unknown, 1), sql.ErrNoRows)
+	})
+
+	t.Run("ConcurrentApplyTransactionAppliesOnce", func(t *testing.T) {
+		store := newStore(t)
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		applied, duplicates := 0, 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				tx := Transaction{TransactionID: "txn-apply-race", UserID: 2, State: "win", Amount: 1, SourceType: "game", CreatedAt: timeNowUTC()}
+				err := store.ApplyTransaction(ctx, tx, 1)
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					applied++
+				case errors.Is(err, ErrDuplicateTransaction):
+					duplicates++
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, 1, applied)
+		assert.Equal(t, 9, duplicates)
+
+		balance, err := store.GetUserBalance(ctx, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, 1.0, balance)
+	})
+
+	t.Run("CancelledContext", func(t *testing.T) {
+		store := newStore(t)
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		assert.ErrorIs(t, store.UpdateUserBalance(cancelled, 1, 1), context.Canceled)
+	})
+}
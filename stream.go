@@ -0,0 +1,490 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// balanceChannel is the NOTIFY channel PostgresStore announces balance changes on
+const balanceChannel = "balance_changes"
+
+// streamRetry is how long EventSource clients wait before reconnecting
+const streamRetry = 3 * time.Second
+
+var (
+	errTooManyStreams     = errors.New("too many balance streams open")
+	errTooManyUserStreams = errors.New("too many balance streams open for this user")
+)
+
+// BalanceUpdate is pushed to the streams of a user whenever their balance
+// changes. Version orders the updates of one user and is used as the event ID.
+type BalanceUpdate struct {
+	UserID        uint64 `json:"userId"`
+	Balance       string `json:"balance"`
+	Delta         string `json:"delta,omitempty"`
+	TransactionID string `json:"transactionId,omitempty"`
+	Version       int64  `json:"version,omitempty"`
+}
+
+// StreamConfig bounds the balance streams a BalanceHub serves
+type StreamConfig struct {
+	MaxConns        int
+	MaxConnsPerUser int
+	Heartbeat       time.Duration
+	// History is how many updates per user are kept for Last-Event-ID
+	// resumes, for at most MaxUsers users without an open stream
+	History  int
+	MaxUsers int
+}
+
+func DefaultStreamConfig() StreamConfig {
+	return StreamConfig{
+		MaxConns:        1000,
+		MaxConnsPerUser: 5,
+		Heartbeat:       15 * time.Second,
+		History:         32,
+		MaxUsers:        10000,
+	}
+}
+
+// BalanceHub fans balance updates out to the open streams of each user and
+// remembers the latest ones so a reconnecting client can catch up.
+type BalanceHub struct {
+	cfg StreamConfig
+
+	mu    sync.Mutex
+	users map[uint64]*hubUser
+	// order lists users by last activity, the least recent at the back
+	order *list.List
+	conns int
+	// seq numbers updates published in process, it starts from the clock so
+	// IDs keep growing across restarts
+	seq int64
+}
+
+type hubUser struct {
+	userID  uint64
+	subs    map[*balanceSub]struct{}
+	history []BalanceUpdate
+	// floor is the version preceding history[0], -1 when unknown
+	floor int64
+	last  int64
+	el    *list.Element
+}
+
+type balanceSub struct {
+	userID  uint64
+	updates chan BalanceUpdate
+}
+
+func NewBalanceHub(cfg StreamConfig) *BalanceHub {
+	return &BalanceHub{
+		cfg:   cfg,
+		users: make(map[uint64]*hubUser),
+		order: list.New(),
+		seq:   time.Now().UnixMicro(),
+	}
+}
+
+// Subscribe opens a stream for userID. When resuming after lastID it also
+// returns the updates missed since, complete reports whether the history
+// still covers all of them.
+func (h *BalanceHub) Subscribe(userID uint64, lastID int64, resume bool) (sub *balanceSub, missed []BalanceUpdate, complete bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.conns >= h.cfg.MaxConns {
+		return nil, nil, false, errTooManyStreams
+	}
+	u := h.user(userID)
+	if len(u.subs) >= h.cfg.MaxConnsPerUser {
+		return nil, nil, false, errTooManyUserStreams
+	}
+
+	sub = &balanceSub{userID: userID, updates: make(chan BalanceUpdate, 16)}
+	u.subs[sub] = struct{}{}
+	h.conns++
+
+	if resume {
+		missed, complete = u.since(lastID)
+	}
+	return sub, missed, complete, nil
+}
+
+// Unsubscribe closes sub, it is safe to call after the hub dropped it
+func (h *BalanceHub) Unsubscribe(sub *balanceSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	u, ok := h.users[sub.userID]
+	if !ok {
+		return
+	}
+	if _, ok := u.subs[sub]; ok {
+		delete(u.subs, sub)
+		close(sub.updates)
+		h.conns--
+	}
+	h.evict()
+}
+
+// Publish hands a change read from Postgres to the user's streams. Versions
+// of a user are consecutive, a jump means notifications were missed.
+func (h *BalanceHub) Publish(update BalanceUpdate) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.publish(update, update.Version-1)
+}
+
+// publishLocal numbers and publishes a change made by this process
+func (h *BalanceHub) publishLocal(update BalanceUpdate) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	update.Version = h.seq
+	h.publish(update, h.user(update.UserID).last)
+}
+
+func (h *BalanceHub) publish(update BalanceUpdate, prev int64) {
+	u := h.user(update.UserID)
+	if update.Version <= u.last {
+		return
+	}
+	if prev != u.last || len(u.history) == 0 {
+		u.history = u.history[:0]
+		u.floor = prev
+	}
+	u.history = append(u.history, update)
+	if len(u.history) > h.cfg.History {
+		u.floor = u.history[0].Version
+		u.history = append(u.history[:0], u.history[1:]...)
+	}
+	u.last = update.Version
+
+	for sub := range u.subs {
+		select {
+		case sub.updates <- update:
+		default:
+			// the client doesn't keep up, it resumes from the history on reconnect
+			h.drop(u, sub)
+		}
+	}
+	h.evict()
+}
+
+// Resync forgets every user and closes every stream, clients reconnect and
+// start over from a fresh balance. Used when updates may have been missed.
+func (h *BalanceHub) Resync() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, u := range h.users {
+		for sub := range u.subs {
+			h.drop(u, sub)
+		}
+	}
+	h.users = make(map[uint64]*hubUser)
+	h.order.Init()
+}
+
+// Conns returns the number of open streams
+func (h *BalanceHub) Conns() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.conns
+}
+
+// user returns the entry of userID, creating it, and marks it as recently used
+func (h *BalanceHub) user(userID uint64) *hubUser {
+	u, ok := h.users[userID]
+	if !ok {
+		u = &hubUser{userID: userID, subs: make(map[*balanceSub]struct{}), floor: -1, last: -1}
+		u.el = h.order.PushFront(u)
+		h.users[userID] = u
+		return u
+	}
+	h.order.MoveToFront(u.el)
+	return u
+}
+
+func (h *BalanceHub) drop(u *hubUser, sub *balanceSub) {
+	delete(u.subs, sub)
+	close(sub.updates)
+	h.conns--
+}
+
+// evict forgets the least recently active users without streams past MaxUsers
+func (h *BalanceHub) evict() {
+	for el := h.order.Back(); el != nil && len(h.users) > h.cfg.MaxUsers; {
+		prev := el.Prev()
+		if u := el.Value.(*hubUser); len(u.subs) == 0 {
+			h.order.Remove(el)
+			delete(h.users, u.userID)
+		}
+		el = prev
+	}
+}
+
+// since returns the updates after lastID and whether none is missing
+func (u *hubUser) since(lastID int64) ([]BalanceUpdate, bool) {
+	if lastID == u.last {
+		return nil, true
+	}
+	if lastID == u.floor {
+		return append([]BalanceUpdate(nil), u.history...), true
+	}
+	for i, update := range u.history {
+		if update.Version == lastID {
+			return append([]BalanceUpdate(nil), u.history[i+1:]...), true
+		}
+	}
+	return nil, false
+}
+
+// BroadcastStore wraps a store without change notifications, such as
+// MemoryStore, and publishes its balance changes to a BalanceHub
+type BroadcastStore struct {
+	Storage
+	hub *BalanceHub
+}
+
+func NewBroadcastStore(store Storage, hub *BalanceHub) *BroadcastStore {
+	return &BroadcastStore{Storage: store, hub: hub}
+}
+
+// Unwrap returns the wrapped store
+func (b *BroadcastStore) Unwrap() Storage {
+	return b.Storage
+}
+
+func (b *BroadcastStore) UpdateUserBalance(ctx context.Context, userID uint64, delta float64) error {
+	if err := b.Storage.UpdateUserBalance(ctx, userID, delta); err != nil {
+		return err
+	}
+	b.broadcast(ctx, userID, delta, "")
+	return nil
+}
+
+func (b *BroadcastStore) ApplyTransaction(ctx context.Context, tx Transaction, delta float64) error {
+	if err := b.Storage.ApplyTransaction(ctx, tx, delta); err != nil {
+		return err
+	}
+	b.broadcast(ctx, tx.UserID, delta, tx.TransactionID)
+	return nil
+}
+
+// broadcast reads the balance back, which may already include a concurrent
+// change; transactions of one user are serialized by the API anyway
+func (b *BroadcastStore) broadcast(ctx context.Context, userID uint64, delta float64, transactionID string) {
+	balance, err := b.Storage.GetUserBalance(WithStrongConsistency(context.WithoutCancel(ctx)), userID)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to read balance for streams", "user_id", userID, "error", err)
+		return
+	}
+	b.hub.publishLocal(BalanceUpdate{
+		UserID:        userID,
+		Balance:       formatAmount(balance),
+		Delta:         formatAmount(delta),
+		TransactionID: transactionID,
+	})
+}
+
+// notifyBalanceChange announces the user's new balance on balanceChannel,
+// Postgres delivers it to listeners when the transaction commits
+func notifyBalanceChange(ctx context.Context, tx *sql.Tx, userID uint64, t *Transaction, delta float64) error {
+	var transactionID sql.NullString
+	if t != nil {
+		transactionID = sql.NullString{String: t.TransactionID, Valid: true}
+	}
+	_, err := tx.ExecContext(ctx, `
+		SELECT pg_notify($1, json_build_object('userId', user_id, 'transactionId', $3::varchar,
+			'delta', $4::numeric, 'balance', balance, 'version', version)::text)
+		FROM users WHERE user_id = $2`,
+		balanceChannel, userID, transactionID, delta)
+	return err
+}
+
+// balanceNotification is the payload of a balanceChannel notification
+type balanceNotification struct {
+	UserID        uint64  `json:"userId"`
+	TransactionID *string `json:"transactionId"`
+	Delta         float64 `json:"delta"`
+	Balance       float64 `json:"balance"`
+	Version       int64   `json:"version"`
+}
+
+func parseBalanceNotification(payload string) (BalanceUpdate, error) {
+	var n balanceNotification
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		return BalanceUpdate{}, err
+	}
+	update := BalanceUpdate{
+		UserID:  n.UserID,
+		Balance: formatAmount(n.Balance),
+		Delta:   formatAmount(n.Delta),
+		Version: n.Version,
+	}
+	if n.TransactionID != nil {
+		update.TransactionID = *n.TransactionID
+	}
+	return update, nil
+}
+
+// ListenBalanceChanges feeds hub with the changes notified by every instance
+// writing to the database until ctx is done. The listener reconnects on its
+// own; notifications sent while it was away are lost, so the hub is resynced.
+func ListenBalanceChanges(ctx context.Context, connStr string, hub *BalanceHub) error {
+	listener := pq.NewListener(connStr, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			slog.Warn("balance listener connection failed", "error", err)
+		}
+	})
+	if err := listener.Listen(balanceChannel); err != nil {
+		listener.Close()
+		return err
+	}
+
+	go func() {
+		defer listener.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case n := <-listener.Notify:
+				if n == nil {
+					slog.Warn("balance listener reconnected, resyncing streams")
+					hub.Resync()
+					continue
+				}
+				update, err := parseBalanceNotification(n.Extra)
+				if err != nil {
+					slog.Error("invalid balance notification", "payload", n.Extra, "error", err)
+					continue
+				}
+				hub.Publish(update)
+			case <-time.After(90 * time.Second):
+				// a quiet connection may be dead without us noticing
+				go listener.Ping()
+			}
+		}
+	}()
+	return nil
+}
+
+// HandleBalanceStream serves GET /user/{userId}/balance/stream as Server-Sent
+// Events: the current balance, then one event per change
+func (s *APIServer) HandleBalanceStream(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseUint(mux.Vars(r)["userId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid userId", http.StatusBadRequest)
+		return
+	}
+
+	// EventSource sends the header when reconnecting, the query parameter
+	// lets a fresh page pick up where a previous one stopped
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	var lastID int64
+	resume := lastEventID != ""
+	if resume {
+		if lastID, err = strconv.ParseInt(lastEventID, 10, 64); err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	sub, missed, complete, err := s.stream.Subscribe(userID, lastID, resume)
+	switch {
+	case errors.Is(err, errTooManyUserStreams):
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Too many balance streams open for this user", http.StatusTooManyRequests)
+		return
+	case err != nil:
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Too many balance streams open", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.stream.Unsubscribe(sub)
+
+	// subscribed first, so no change slips between this read and the stream
+	var snapshot *BalanceUpdate
+	if !complete {
+		ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+		var balance float64
+		err := s.traceStore(ctx, "GetUserBalance", func(ctx context.Context) (err error) {
+			balance, err = s.store.GetUserBalance(WithStrongConsistency(ctx), userID)
+			return err
+		})
+		cancel()
+		if isTimeout(err) {
+			http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+			return
+		}
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		snapshot = &BalanceUpdate{UserID: userID, Balance: formatAmount(balance)}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// keeps proxies such as nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetry.Milliseconds())
+	if snapshot != nil {
+		// no ID, the snapshot isn't a point the history can resume from
+		writeSSE(w, *snapshot, false)
+	}
+	for _, update := range missed {
+		writeSSE(w, update, true)
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(s.stream.cfg.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case update, ok := <-sub.updates:
+			if !ok {
+				// dropped by the hub, the client reconnects and resumes
+				return
+			}
+			writeSSE(w, update, true)
+		case <-heartbeat.C:
+			io.WriteString(w, ": heartbeat\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeSSE(w io.Writer, update BalanceUpdate, withID bool) {
+	data, _ := json.Marshal(update)
+	if withID {
+		fmt.Fprintf(w, "id: %d\n", update.Version)
+	}
+	fmt.Fprintf(w, "event: balance\ndata: %s\n\n", data)
+}
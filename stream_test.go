@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func publishVersions(hub *BalanceHub, userID uint64, versions ...int64) {
+	for _, v := range versions {
+		hub.Publish(BalanceUpdate{UserID: userID, Balance: formatAmount(float64(v)), Version: v})
+	}
+}
+
+func versionsOf(updates []BalanceUpdate) []int64 {
+	var versions []int64
+	for _, u := range updates {
+		versions = append(versions, u.Version)
+	}
+	return versions
+}
+
+func TestBalanceHub_Resume(t *testing.T) {
+	cfg := DefaultStreamConfig()
+	cfg.History = 3
+	hub := NewBalanceHub(cfg)
+	publishVersions(hub, 1, 1, 2, 3, 4)
+
+	cases := []struct {
+		lastID   int64
+		missed   []int64
+		complete bool
+	}{
+		{lastID: 4, complete: true},
+		{lastID: 2, missed: []int64{3, 4}, complete: true},
+		{lastID: 1, missed: []int64{2, 3, 4}, complete: true},
+		{lastID: 0, complete: false}, // trimmed from the history
+		{lastID: 9, complete: false},
+	}
+	for _, c := range cases {
+		sub, missed, complete, err := hub.Subscribe(1, c.lastID, true)
+		require.NoError(t, err)
+		assert.Equal(t, c.missed, versionsOf(missed), "after %d", c.lastID)
+		assert.Equal(t, c.complete, complete, "after %d", c.lastID)
+		hub.Unsubscribe(sub)
+	}
+
+	// a version jump means notifications were lost, older resumes need a snapshot
+	publishVersions(hub, 1, 7)
+	_, _, complete, err := hub.Subscribe(1, 4, true)
+	require.NoError(t, err)
+	assert.False(t, complete)
+
+	sub, missed, complete, err := hub.Subscribe(1, 6, true)
+	require.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, []int64{7}, versionsOf(missed))
+	hub.Unsubscribe(sub)
+}
+
+func TestBalanceHub_Limits(t *testing.T) {
+	cfg := DefaultStreamConfig()
+	cfg.MaxConns = 2
+	cfg.MaxConnsPerUser = 1
+	hub := NewBalanceHub(cfg)
+
+	a, _, _, err := hub.Subscribe(1, 0, false)
+	require.NoError(t, err)
+	_, _, _, err = hub.Subscribe(1, 0, false)
+	assert.ErrorIs(t, err, errTooManyUserStreams)
+
+	_, _, _, err = hub.Subscribe(2, 0, false)
+	require.NoError(t, err)
+	_, _, _, err = hub.Subscribe(3, 0, false)
+	assert.ErrorIs(t, err, errTooManyStreams)
+
+	hub.Unsubscribe(a)
+	hub.Unsubscribe(a)
+	assert.Equal(t, 1, hub.Conns())
+}
+
+func TestBalanceHub_DropsSlowSubscriber(t *testing.T) {
+	hub := NewBalanceHub(DefaultStreamConfig())
+	sub, _, _, err := hub.Subscribe(1, 0, false)
+	require.NoError(t, err)
+
+	for v := int64(1); v <= int64(cap(sub.updates))+1; v++ {
+		publishVersions(hub, 1, v)
+	}
+
+	received := 0
+	for range sub.updates {
+		received++
+	}
+	assert.Equal(t, cap(sub.updates), received, "buffered updates are delivered before the stream closes")
+	assert.Equal(t, 0, hub.Conns())
+	hub.Unsubscribe(sub)
+}
+
+func TestBalanceHub_ResyncClosesStreams(t *testing.T) {
+	hub := NewBalanceHub(DefaultStreamConfig())
+	publishVersions(hub, 1, 1, 2)
+	sub, _, _, err := hub.Subscribe(1, 0, false)
+	require.NoError(t, err)
+
+	hub.Resync()
+	_, ok := <-sub.updates
+	assert.False(t, ok)
+	assert.Equal(t, 0, hub.Conns())
+
+	_, _, complete, err := hub.Subscribe(1, 2, true)
+	require.NoError(t, err)
+	assert.False(t, complete, "the history is gone after a resync")
+}
+
+func TestBalanceHub_EvictsIdleUsers(t *testing.T) {
+	cfg := DefaultStreamConfig()
+	cfg.MaxUsers = 2
+	hub := NewBalanceHub(cfg)
+
+	sub, _, _, err := hub.Subscribe(1, 0, false)
+	require.NoError(t, err)
+	publishVersions(hub, 1, 1)
+	publishVersions(hub, 2, 1)
+	publishVersions(hub, 3, 1)
+
+	assert.Len(t, hub.users, 2)
+	assert.Contains(t, hub.users, uint64(1), "users with open streams are kept")
+	assert.Contains(t, hub.users, uint64(3))
+	hub.Unsubscribe(sub)
+}
+
+func TestParseBalanceNotification(t *testing.T) {
+	update, err := parseBalanceNotification(`{"userId" : 1, "transactionId" : "txn-1", "delta" : -10.5, "balance" : 39.5, "version" : 12}`)
+	require.NoError(t, err)
+	assert.Equal(t, BalanceUpdate{UserID: 1, TransactionID: "txn-1", Delta: "-10.50", Balance: "39.50", Version: 12}, update)
+
+	update, err = parseBalanceNotification(`{"userId" : 2, "transactionId" : null, "delta" : 5, "balance" : 5, "version" : 1}`)
+	require.NoError(t, err)
+	assert.Empty(t, update.TransactionID)
+}
+
+func TestApplyTransaction_NotifiesBalanceChange(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	store := &PostgresStore{Db: db, notify: true}
+	tx := Transaction{TransactionID: "txn-ntf", UserID: 1, State: "win", Amount: 10.0, SourceType: "game", CreatedAt: time.Now()}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT balance FROM users WHERE user_id = \\$1 FOR UPDATE").
+		WithArgs(tx.UserID).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(50.0))
+	mock.ExpectExec("INSERT INTO transactions").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("UPDATE users SET balance").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("SELECT pg_notify\\(\\$1, json_build_object").
+		WithArgs(balanceChannel, tx.UserID, "txn-ntf", 10.0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, store.ApplyTransaction(context.Background(), tx, 10.0))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestConditionalQuery_Notify(t *testing.T) {
+	assert.NotContains(t, conditionalQuery(true, false, false), "pg_notify")
+	q := conditionalQuery(true, false, true)
+	assert.Contains(t, q, "pg_notify('balance_changes'")
+	assert.Contains(t, q, "FROM (SELECT count(*) FROM ntf) notified")
+	assert.Contains(t, conditionalQuery(false, false, true), "'transactionId', NULL")
+}
+
+// sseEvent is one event read from a balance stream
+type sseEvent struct {
+	id     string
+	update BalanceUpdate
+}
+
+// openStream connects to the balance stream and returns its events as they arrive
+func openStream(t *testing.T, url, lastEventID string) (*http.Response, <-chan sseEvent) {
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		var ev sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				ev.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev.update)
+			case line == "" && ev.update.UserID != 0:
+				events <- ev
+				ev = sseEvent{}
+			}
+		}
+	}()
+	return resp, events
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	select {
+	case ev, ok := <-events:
+		require.True(t, ok, "stream closed")
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event received")
+		return sseEvent{}
+	}
+}
+
+func TestHandleBalanceStream(t *testing.T) {
+	mem := NewMemoryStore()
+	require.NoError(t, mem.Init(context.Background()))
+	hub := NewBalanceHub(DefaultStreamConfig())
+	srv := httptest.NewServer(NewAPIServer(NewBroadcastStore(mem, hub), WithBalanceStream(hub)).Router())
+	// registered first so it runs after the streams are closed
+	t.Cleanup(srv.Close)
+
+	post := func(txID, amount string) {
+		body, _ := json.Marshal(TransactionRequest{State: "win", Amount: amount, TransactionID: txID})
+		req, _ := http.NewRequest("POST", srv.URL+"/user/1/transaction", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Source-Type", "game")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	resp, events := openStream(t, srv.URL+"/user/1/balance/stream", "")
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	snapshot := nextEvent(t, events)
+	assert.Empty(t, snapshot.id, "a snapshot has no event ID")
+	assert.Equal(t, "0.00", snapshot.update.Balance)
+
+	post("txn-stream-1", "10.15")
+	first := nextEvent(t, events)
+	assert.Equal(t, strconv.FormatInt(first.update.Version, 10), first.id)
+	assert.Equal(t, "10.15", first.update.Balance)
+	assert.Equal(t, "10.15", first.update.Delta)
+	assert.Equal(t, "txn-stream-1", first.update.TransactionID)
+	resp.Body.Close()
+
+	// changes made while disconnected are replayed on resume, without a snapshot
+	post("txn-stream-2", "5.00")
+	_, events = openStream(t, srv.URL+"/user/1/balance/stream", first.id)
+	missed := nextEvent(t, events)
+	assert.Equal(t, "txn-stream-2", missed.update.TransactionID)
+	assert.Equal(t, "15.15", missed.update.Balance)
+}
+
+func TestHandleBalanceStream_Errors(t *testing.T) {
+	cfg := DefaultStreamConfig()
+	cfg.MaxConnsPerUser = 1
+	hub := NewBalanceHub(cfg)
+	srv := httptest.NewServer(NewAPIServer(NewMockStore(), WithBalanceStream(hub)).Router())
+	// registered first so it runs after the streams are closed
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL + "/user/999/balance/stream")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/user/1/balance/stream?lastEventId=abc")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	_, events := openStream(t, srv.URL+"/user/1/balance/stream", "")
+	nextEvent(t, events)
+	resp, err = http.Get(srv.URL + "/user/1/balance/stream")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "5", resp.Header.Get("Retry-After"))
+}
+
+func TestHandleBalanceStream_Heartbeat(t *testing.T) {
+	cfg := DefaultStreamConfig()
+	cfg.Heartbeat = 10 * time.Millisecond
+	hub := NewBalanceHub(cfg)
+	srv := httptest.NewServer(NewAPIServer(NewMockStore(), WithBalanceStream(hub)).Router())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/user/1/balance/stream")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if scanner.Text() == ": heartbeat" {
+			return
+		}
+	}
+	t.Fatal("no heartbeat received")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (e *recordingExporter) ExportSpan(span SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+	return nil
+}
+
+func (e *recordingExporter) Shutdown() error {
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	for _, header := range []string{
+		"",
+		"garbage",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-zzf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, ok := ParseTraceparent(header)
+		assert.False(t, ok, header)
+	}
+}
+
+func TestTracing_PropagatesIncomingTrace(t *testing.T) {
+	exporter := &recordingExporter{}
+	server := NewAPIServer(NewMockStore(), WithTracer(NewTracer(exporter)))
+	router := server.Router()
+
+	body, _ := json.Marshal(TransactionRequest{State: "win", Amount: "1.00", TransactionID: "txn-trace"})
+	req := httptest.NewRequest("POST", "/user/1/transaction", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Source-Type", "game")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", rr.Header().Get(traceIDHeader))
+
+	// storage spans finish before the server span
+	assert.Len(t, exporter.spans, 3)
+	serverSpan := exporter.spans[len(exporter.spans)-1]
+	assert.Equal(t, "POST /user/{userId}/transaction", serverSpan.Name)
+	assert.Equal(t, "server", serverSpan.Kind)
+	assert.Equal(t, "00f067aa0ba902b7", serverSpan.ParentSpanID)
+
+	var names []string
+	for _, span := range exporter.spans[:2] {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.TraceID)
+		assert.Equal(t, serverSpan.SpanID, span.ParentSpanID)
+		names = append(names, span.Name)
+	}
+	assert.Equal(t, []string{"store.GetTransactionByID", "store.ApplyTransaction"}, names)
+}
+
+func TestTracing_StartsNewTraceAndSkipsUnsampled(t *testing.T) {
+	exporter := &recordingExporter{}
+	server := NewAPIServer(NewMockStore(), WithTracer(NewTracer(exporter)))
+	router := server.Router()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/user/1/balance", nil))
+
+	traceID := rr.Header().Get(traceIDHeader)
+	assert.Len(t, traceID, 32)
+	assert.Len(t, exporter.spans, 2)
+	assert.Equal(t, traceID, exporter.spans[1].TraceID)
+	assert.Empty(t, exporter.spans[1].ParentSpanID)
+
+	exporter.spans = nil
+	req := httptest.NewRequest("GET", "/user/1/balance", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", rr.Header().Get(traceIDHeader))
+	assert.Empty(t, exporter.spans)
+}
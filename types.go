@@ -28,3 +28,39 @@ type Transaction struct {
 	SourceType    string    `json:"sourceType"`
 	CreatedAt     time.Time `json:"created_at"`
 }
+
+// TransactionResponse is a Transaction as returned by the API, with its
+// amount formatted like balances
+type TransactionResponse struct {
+	ID            int64     `json:"id"`
+	TransactionID string    `json:"transactionId"`
+	UserID        uint64    `json:"userId"`
+	State         string    `json:"state"`
+	Amount        string    `json:"amount"`
+	SourceType    string    `json:"sourceType"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+func newTransactionResponse(tx Transaction) TransactionResponse {
+	return TransactionResponse{
+		ID:            tx.ID,
+		TransactionID: tx.TransactionID,
+		UserID:        tx.UserID,
+		State:         tx.State,
+		Amount:        formatAmount(tx.Amount),
+		SourceType:    tx.SourceType,
+		CreatedAt:     tx.CreatedAt,
+	}
+}
+
+// TransactionHistoryResponse is a page of transactions, newest first.
+// NextBeforeID is the beforeId of the next page, 0 on the last one.
+type TransactionHistoryResponse struct {
+	Transactions []TransactionResponse `json:"transactions"`
+	NextBeforeID int64                 `json:"nextBeforeId,omitempty"`
+}
+
+type ReversalResponse struct {
+	Status   string              `json:"status"`
+	Reversal TransactionResponse `json:"reversal"`
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiVersion is one version of the REST API. Every version is served by the
+// same handlers, which read what differs between versions, the shape of the
+// payloads and the document bodies are validated against, from the version
+// the route was registered with. A /v2 sending amounts as integer minor units
+// only needs its own apiVersion with its own payloadCodec and document.
+//
+// Balance streams, socket frames and webhook management keep one shape and are
+// simply served under every prefix.
+type apiVersion struct {
+	// prefix is prepended to every route of the version
+	prefix string
+	// document is served at <prefix>/openapi.json, spec is its parsed form
+	// used to validate bodies, nil skips validation
+	document []byte
+	spec     *openAPIDocument
+	payloads payloadCodec
+}
+
+// payloadCodec converts between the JSON payloads of a version and the
+// types of the service
+type payloadCodec interface {
+	// decodeTransaction reads the body of a transaction request
+	decodeTransaction(w http.ResponseWriter, r *http.Request) (TransactionRequest, *ValidationError)
+	balance(res BalanceResult) any
+	history(page HistoryPage) any
+	reversal(status string, reversal Transaction) any
+}
+
+// apiV1 is the current version, also answering on the legacy unversioned paths
+var apiV1 = &apiVersion{
+	prefix:   "/v1",
+	document: openAPISpec,
+	spec:     openAPI,
+	payloads: v1Payloads{},
+}
+
+// apiVersions lists the versions served, oldest first
+var apiVersions = []*apiVersion{apiV1}
+
+// legacyDeprecation is when the unversioned paths were deprecated in favour of /v1
+var legacyDeprecation = time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC)
+
+// defaultLegacySunset leaves clients six months to move to /v1
+var defaultLegacySunset = legacyDeprecation.AddDate(0, 6, 0)
+
+// v1Payloads carries amounts and balances as decimal strings, e.g. "10.15"
+type v1Payloads struct{}
+
+func (v1Payloads) decodeTransaction(w http.ResponseWriter, r *http.Request) (TransactionRequest, *ValidationError) {
+	var txReq TransactionRequest
+	verr := decodeJSONBody(w, r, &txReq)
+	return txReq, verr
+}
+
+func (v1Payloads) balance(res BalanceResult) any {
+	return BalanceResponse{
+		UserID:  res.UserID,
+		Balance: formatAmount(res.Balance),
+	}
+}
+
+func (v1Payloads) history(page HistoryPage) any {
+	resp := TransactionHistoryResponse{
+		Transactions: make([]TransactionResponse, 0, len(page.Transactions)),
+		NextBeforeID: page.NextBeforeID,
+	}
+	for _, tx := range page.Transactions {
+		resp.Transactions = append(resp.Transactions, newTransactionResponse(tx))
+	}
+	return resp
+}
+
+func (v1Payloads) reversal(status string, reversal Transaction) any {
+	return ReversalResponse{
+		Status:   status,
+		Reversal: newTransactionResponse(reversal),
+	}
+}
+
+type apiVersionKey struct{}
+
+// versionOf returns the API version of the route serving r, apiV1 for a
+// handler called outside the router
+func versionOf(r *http.Request) *apiVersion {
+	if v, ok := r.Context().Value(apiVersionKey{}).(*apiVersion); ok {
+		return v
+	}
+	return apiV1
+}
+
+// registerAPI adds the routes of the REST API to router, answering with the
+// payloads of version
+func (s *APIServer) registerAPI(router *mux.Router, version *apiVersion) {
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version)))
+		})
+	})
+	router.Use(RequestValidationMiddleware)
+
+	router.HandleFunc("/user/{userId}/transaction", s.HandleTransaction).Methods("POST")
+	router.HandleFunc("/user/{userId}/balance", s.HandleGetBalance).Methods("GET")
+	router.HandleFunc("/user/{userId}/transactions", s.HandleListTransactions).Methods("GET")
+	router.HandleFunc("/transactions/{transactionId}/reverse", s.HandleReverseTransaction).Methods("POST")
+	if s.stream != nil {
+		router.HandleFunc("/user/{userId}/balance/stream", s.HandleBalanceStream).Methods("GET")
+	}
+	if s.sockets != nil {
+		router.HandleFunc("/transactions/ws", s.HandleTransactionSocket).Methods("GET")
+	}
+	router.HandleFunc("/openapi.json", s.HandleOpenAPI).Methods("GET")
+
+	if s.webhooks != nil {
+		admin := router.PathPrefix("/webhooks").Subrouter()
+		admin.Use(s.webhookAdmin)
+		admin.HandleFunc("/subscriptions", s.HandleCreateWebhook).Methods("POST")
+		admin.HandleFunc("/subscriptions", s.HandleListWebhooks).Methods("GET")
+		admin.HandleFunc("/subscriptions/{id}", s.HandleDeleteWebhook).Methods("DELETE")
+		admin.HandleFunc("/deliveries", s.HandleListDeliveries).Methods("GET")
+		admin.HandleFunc("/deliveries/{id}/redeliver", s.HandleRedeliver).Methods("POST")
+	}
+}
+
+// deprecated marks the answers of the legacy unversioned routes as deprecated
+// (RFC 9745) until the sunset (RFC 8594), and links to the same path under
+// successor
+func (s *APIServer) deprecated(successor *apiVersion) mux.MiddlewareFunc {
+	deprecation := fmt.Sprintf("@%d", legacyDeprecation.Unix())
+	sunset := s.legacySunset.UTC().Format(http.TimeFormat)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Set("Deprecation", deprecation)
+			h.Set("Sunset", sunset)
+			h.Add("Link", fmt.Sprintf(`<%s%s>; rel="successor-version"`, successor.prefix, r.URL.EscapedPath()))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
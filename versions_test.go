@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIVersions_LegacyPathsAreDeprecated(t *testing.T) {
+	sunset := time.Date(2027, time.January, 31, 0, 0, 0, 0, time.UTC)
+	router := NewAPIServer(NewMockStore(), WithLegacySunset(sunset)).Router()
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Source-Type", "game")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send("POST", "/v1/user/1/transaction", `{"state":"win","amount":"2.50","transactionId":"ver-1"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Empty(t, rr.Header().Get("Deprecation"))
+
+	v1 := send("GET", "/v1/user/1/balance", "")
+	legacy := send("GET", "/user/1/balance", "")
+	require.Equal(t, http.StatusOK, v1.Code)
+	assert.Equal(t, v1.Body.String(), legacy.Body.String(), "both paths share the handler")
+	assert.Empty(t, v1.Header().Get("Sunset"))
+
+	assert.Equal(t, fmt.Sprintf("@%d", legacyDeprecation.Unix()), legacy.Header().Get("Deprecation"))
+	assert.Equal(t, "Sun, 31 Jan 2027 00:00:00 GMT", legacy.Header().Get("Sunset"))
+	assert.Equal(t, `</v1/user/1/balance>; rel="successor-version"`, legacy.Header().Get("Link"))
+
+	// refusals of the legacy paths are marked as well
+	rr = send("POST", "/user/1/transaction", `{"state":"win","amount":"2.50"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Deprecation"))
+
+	rr = send("GET", "/v1/openapi.json", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("Deprecation"))
+
+	// operational endpoints are not versioned
+	rr = send("GET", "/livez", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("Deprecation"))
+	assert.Equal(t, http.StatusNotFound, send("GET", "/v1/livez", "").Code)
+}
+
+// minorUnitPayloads is how a /v2 could carry amounts, as integer cents
+type minorUnitPayloads struct{ v1Payloads }
+
+func (minorUnitPayloads) decodeTransaction(w http.ResponseWriter, r *http.Request) (TransactionRequest, *ValidationError) {
+	var body struct {
+		State         string `json:"state"`
+		AmountMinor   int64  `json:"amountMinor"`
+		TransactionID string `json:"transactionId"`
+	}
+	if verr := decodeJSONBody(w, r, &body); verr != nil {
+		return TransactionRequest{}, verr
+	}
+	if body.AmountMinor < 0 {
+		return TransactionRequest{}, invalid("amountMinor", "invalid_amount", "Invalid amount format")
+	}
+	return TransactionRequest{
+		State:         body.State,
+		Amount:        fmt.Sprintf("%d.%02d", body.AmountMinor/100, body.AmountMinor%100),
+		TransactionID: body.TransactionID,
+	}, nil
+}
+
+func (minorUnitPayloads) balance(res BalanceResult) any {
+	return map[string]any{"userId": res.UserID, "balanceMinor": int64(math.Round(res.Balance * 100))}
+}
+
+func TestAPIVersions_ShareHandlers(t *testing.T) {
+	server := NewAPIServer(NewMockStore())
+	router := mux.NewRouter()
+	server.registerAPI(router.PathPrefix("/v2").Subrouter(), &apiVersion{prefix: "/v2", payloads: minorUnitPayloads{}})
+	server.registerAPI(router.PathPrefix("/v1").Subrouter(), apiV1)
+
+	req := httptest.NewRequest("POST", "/v2/user/1/transaction", strings.NewReader(`{"state":"win","amountMinor":1015,"transactionId":"v2-1"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Source-Type", "game")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/v2/user/1/balance", nil))
+	var v2 map[string]any
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &v2))
+	assert.Equal(t, 1015.0, v2["balanceMinor"])
+
+	// the balance written through /v2 reads the same through /v1
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/user/1/balance", nil))
+	var v1 BalanceResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &v1))
+	assert.Equal(t, "10.15", v1.Balance)
+}
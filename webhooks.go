@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// EventTransactionRejected is sent when a transaction is refused for lack of funds
+const EventTransactionRejected = "transaction.rejected"
+
+// webhookEventTypes are the event types a subscription can ask for
+var webhookEventTypes = map[string]bool{
+	EventBalanceChanged:      true,
+	EventTransactionRejected: true,
+}
+
+// errInvalidSubscription wraps the reasons a subscription is refused
+var errInvalidSubscription = errors.New("invalid subscription")
+
+// Delivery statuses
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// TransactionRejectedEvent is the payload of transaction.rejected webhooks
+type TransactionRejectedEvent struct {
+	ID            string    `json:"id"`
+	Type          string    `json:"type"`
+	UserID        uint64    `json:"userId"`
+	TransactionID string    `json:"transactionId"`
+	State         string    `json:"state"`
+	Amount        string    `json:"amount"`
+	SourceType    string    `json:"sourceType"`
+	Reason        string    `json:"reason"`
+	OccurredAt    time.Time `json:"occurredAt"`
+}
+
+type WebhookSubscription struct {
+	ID         int64     `json:"id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"eventTypes"`
+	Secret     string    `json:"secret,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+type WebhookDelivery struct {
+	ID             int64      `json:"id"`
+	SubscriptionID int64      `json:"subscriptionId"`
+	EventType      string     `json:"eventType"`
+	EventID        string     `json:"eventId"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	LastStatusCode *int       `json:"lastStatusCode,omitempty"`
+	LastError      *string    `json:"lastError,omitempty"`
+	NextAttemptAt  time.Time  `json:"nextAttemptAt"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	DeliveredAt    *time.Time `json:"deliveredAt,omitempty"`
+}
+
+// WebhookConfig tunes the delivery worker
+type WebhookConfig struct {
+	PollInterval time.Duration
+	BatchSize    int
+	Timeout      time.Duration
+	// MaxAttempts marks a delivery failed after that many unsuccessful attempts
+	MaxAttempts int
+	Retry       RetryPolicy
+	// AdminToken is the bearer token required by the subscription and
+	// delivery endpoints, which refuse every request when it is empty
+	AdminToken string
+	// AllowPrivateTargets lets subscriptions reach loopback, private and
+	// link-local addresses, only meant for tests and closed networks
+	AllowPrivateTargets bool
+}
+
+func DefaultWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		PollInterval: time.Second,
+		BatchSize:    50,
+		Timeout:      10 * time.Second,
+		MaxAttempts:  12,
+		Retry:        RetryPolicy{InitialBackoff: 5 * time.Second, MaxBackoff: time.Hour},
+	}
+}
+
+// WebhookService stores partner subscriptions in Postgres, queues a delivery
+// per subscription for every matching event and sends them with retries.
+// It is a Publisher, so the outbox relay feeds it balance changes.
+type WebhookService struct {
+	db     *sql.DB
+	client *http.Client
+	cfg    WebhookConfig
+}
+
+func NewWebhookService(db *sql.DB, cfg WebhookConfig) *WebhookService {
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if !cfg.AllowPrivateTargets {
+		// checked on the resolved address of every connection, redirects and
+		// names resolving to internal hosts included
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || internalIP(ip) {
+				return fmt.Errorf("webhook target %s is not a public address", host)
+			}
+			return nil
+		}
+	}
+	return &WebhookService{
+		db: db,
+		client: &http.Client{
+			Timeout:   cfg.Timeout,
+			Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: cfg.Timeout},
+		},
+		cfg: cfg,
+	}
+}
+
+// internalIP reports whether ip is an address partners must not make the
+// service call, e.g. 127.0.0.1, 10.0.0.0/8 or the cloud metadata endpoint
+func internalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+}
+
+// CreateSubscription validates and stores sub, generating a secret when it has none
+func (w *WebhookService) CreateSubscription(ctx context.Context, sub WebhookSubscription) (*WebhookSubscription, error) {
+	u, err := url.Parse(sub.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: url must be an absolute http or https URL", errInvalidSubscription)
+	}
+	if !w.cfg.AllowPrivateTargets {
+		host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+		ip := net.ParseIP(host)
+		if host == "localhost" || strings.HasSuffix(host, ".localhost") || (ip != nil && internalIP(ip)) {
+			return nil, fmt.Errorf("%w: url must not point to a loopback, private or link-local address", errInvalidSubscription)
+		}
+	}
+	if len(sub.EventTypes) == 0 {
+		return nil, fmt.Errorf("%w: eventTypes must not be empty", errInvalidSubscription)
+	}
+	for _, t := range sub.EventTypes {
+		if !webhookEventTypes[t] {
+			return nil, fmt.Errorf("%w: unknown event type %q", errInvalidSubscription, t)
+		}
+	}
+	if sub.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		sub.Secret = hex.EncodeToString(secret)
+	}
+
+	err = w.db.QueryRowContext(ctx, `
+		INSERT INTO webhook_subscriptions (url, event_types, secret) VALUES ($1, $2, $3)
+		RETURNING id, created_at`,
+		sub.URL, strings.Join(sub.EventTypes, ","), sub.Secret).Scan(&sub.ID, &sub.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// ListSubscriptions returns every subscription, secrets left out
+func (w *WebhookService) ListSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	rows, err := w.db.QueryContext(ctx, "SELECT id, url, event_types, created_at FROM webhook_subscriptions ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := []WebhookSubscription{}
+	for rows.Next() {
+		var sub WebhookSubscription
+		var eventTypes string
+		if err := rows.Scan(&sub.ID, &sub.URL, &eventTypes, &sub.CreatedAt); err != nil {
+			return nil, err
+		}
+		sub.EventTypes = strings.Split(eventTypes, ",")
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// DeleteSubscription removes a subscription and its delivery log
+func (w *WebhookService) DeleteSubscription(ctx context.Context, id int64) error {
+	res, err := w.db.ExecContext(ctx, "DELETE FROM webhook_subscriptions WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Enqueue queues payload for every subscription of eventType. Enqueueing the
+// same eventID twice is a no-op, so at-least-once producers are safe.
+func (w *WebhookService) Enqueue(ctx context.Context, eventType, eventID string, payload []byte) error {
+	_, err := w.db.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (subscription_id, event_type, event_id, payload)
+		SELECT id, $1, $2::varchar, $3::text FROM webhook_subscriptions
+		WHERE $1 = ANY (string_to_array(event_types, ','))
+		ON CONFLICT (subscription_id, event_id) DO NOTHING`,
+		eventType, eventID, string(payload))
+	return err
+}
+
+// Publish queues a balance change coming from the outbox relay
+func (w *WebhookService) Publish(ctx context.Context, event BalanceEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return w.Enqueue(ctx, event.Type, fmt.Sprintf("%s:%d", event.Type, event.ID), payload)
+}
+
+// ListDeliveries returns the most recent deliveries first, optionally filtered
+// by subscription and status
+func (w *WebhookService) ListDeliveries(ctx context.Context, subscriptionID int64, status string, limit int) ([]WebhookDelivery, error) {
+	query := `
+		SELECT id, subscription_id, event_type, event_id, status, attempts, last_status_code,
+		       last_error, next_attempt_at, created_at, delivered_at
+		FROM webhook_deliveries WHERE TRUE`
+	var args []any
+	if subscriptionID != 0 {
+		args = append(args, subscriptionID)
+		query += fmt.Sprintf(" AND subscription_id = $%d", len(args))
+	}
+	if status != "" {
+		args = append(args, status)
+		query += fmt.Sprintf(" AND status = $%d", len(args))
+	}
+	args = append(args, limit)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	rows, err := w.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		err := rows.Scan(&d.ID, &d.SubscriptionID, &d.EventType, &d.EventID, &d.Status, &d.Attempts,
+			&d.LastStatusCode, &d.LastError, &d.NextAttemptAt, &d.CreatedAt, &d.DeliveredAt)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// Redeliver queues a delivery again right away, whatever its status
+func (w *WebhookService) Redeliver(ctx context.Context, id int64) error {
+	res, err := w.db.ExecContext(ctx, `
+		UPDATE webhook_deliveries SET status = $2, attempts = 0, next_attempt_at = NOW()
+		WHERE id = $1`, id, deliveryPending)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Run sends due deliveries until ctx is done, polling when none are left
+func (w *WebhookService) Run(ctx context.Context) {
+	for {
+		sent, err := w.DeliverOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "webhook delivery failed", "error", err)
+		}
+		if sent > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.cfg.PollInterval):
+		}
+	}
+}
+
+// claimDeliveriesQuery leases a batch of due deliveries by pushing their next
+// attempt past the time needed to send the whole batch, so concurrent workers
+// skip them and a worker that dies mid-batch doesn't lose them
+const claimDeliveriesQuery = `
+	UPDATE webhook_deliveries d SET next_attempt_at = NOW() + $2::float8 * INTERVAL '1 millisecond'
+	FROM webhook_subscriptions s
+	WHERE s.id = d.subscription_id AND d.id IN (
+		SELECT id FROM webhook_deliveries
+		WHERE status = 'pending' AND next_attempt_at <= NOW()
+		ORDER BY next_attempt_at, id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING d.id, d.event_type, d.payload, d.attempts, s.url, s.secret`
+
+type claimedDelivery struct {
+	id        int64
+	eventType string
+	payload   []byte
+	attempts  int
+	url       string
+	secret    string
+}
+
+// DeliverOnce sends one batch of due deliveries and returns how many it attempted
+func (w *WebhookService) DeliverOnce(ctx context.Context) (int, error) {
+	// deliveries are sent one after the other, each taking up to the timeout
+	lease := time.Duration(w.cfg.BatchSize+1) * w.cfg.Timeout
+	claimed := time.Now()
+	rows, err := w.db.QueryContext(ctx, claimDeliveriesQuery, w.cfg.BatchSize, lease.Milliseconds())
+	if err != nil {
+		return 0, err
+	}
+	var batch []claimedDelivery
+	for rows.Next() {
+		var d claimedDelivery
+		var payload string
+		if err := rows.Scan(&d.id, &d.eventType, &payload, &d.attempts, &d.url, &d.secret); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		d.payload = []byte(payload)
+		batch = append(batch, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, d := range batch {
+		if time.Since(claimed) > lease-w.cfg.Timeout {
+			// slow records ate the lease, what is left is claimed again once it expires
+			return i, nil
+		}
+		status, err := w.send(ctx, d)
+		if ctx.Err() != nil {
+			// the lease expires and another attempt picks it up
+			return len(batch), ctx.Err()
+		}
+		if err := w.record(ctx, d, status, err); err != nil {
+			return len(batch), err
+		}
+	}
+	return len(batch), nil
+}
+
+// send POSTs the payload signed with the subscription secret and returns the response status
+func (w *WebhookService) send(ctx context.Context, d claimedDelivery) (int, error) {
+	timestamp := time.Now().Unix()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(d.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Webhook-Id", strconv.FormatInt(d.id, 10))
+	req.Header.Set("Webhook-Event", d.eventType)
+	req.Header.Set("Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("Webhook-Signature", signWebhook(d.secret, timestamp, d.payload))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// record stores the outcome of an attempt and schedules the next one with
+// exponential backoff and jitter
+func (w *WebhookService) record(ctx context.Context, d claimedDelivery, status int, cause error) error {
+	attempts := d.attempts + 1
+	statusCode := sql.NullInt64{Int64: int64(status), Valid: status != 0}
+
+	if cause == nil {
+		_, err := w.db.ExecContext(ctx, `
+			UPDATE webhook_deliveries SET status = $2, attempts = $3, last_status_code = $4, last_error = NULL, delivered_at = NOW()
+			WHERE id = $1`, d.id, deliveryDelivered, attempts, statusCode)
+		return err
+	}
+
+	next := deliveryPending
+	delay := w.cfg.Retry.Backoff(attempts)
+	if attempts >= w.cfg.MaxAttempts {
+		next = deliveryFailed
+		delay = 0
+	}
+	slog.WarnContext(ctx, "webhook not delivered",
+		"delivery_id", d.id, "attempt", attempts, "status", next, "delay_ms", delay.Milliseconds(), "error", cause)
+	_, err := w.db.ExecContext(ctx, `
+		UPDATE webhook_deliveries SET status = $2, attempts = $3, last_status_code = $4, last_error = $5,
+		       next_attempt_at = NOW() + $6::float8 * INTERVAL '1 millisecond'
+		WHERE id = $1`, d.id, next, attempts, statusCode, cause.Error(), delay.Milliseconds())
+	return err
+}
+
+// signWebhook returns the Webhook-Signature value: an HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the subscription secret
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature checks the Webhook-Signature of a received body and
+// rejects timestamps further than tolerance from now, against replays
+func VerifyWebhookSignature(secret, timestamp, signature string, body []byte, tolerance time.Duration) bool {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > tolerance || age < -tolerance {
+		return false
+	}
+	return hmac.Equal([]byte(signWebhook(secret, ts, body)), []byte(signature))
+}
+
+// publishRejection queues a transaction.rejected webhook, failures are only logged
+func (b *BalanceService) publishRejection(ctx context.Context, tx Transaction, reason string) {
+	if b.webhooks == nil {
+		return
+	}
+	event := TransactionRejectedEvent{
+		ID:            EventTransactionRejected + ":" + tx.TransactionID,
+		Type:          EventTransactionRejected,
+		UserID:        tx.UserID,
+		TransactionID: tx.TransactionID,
+		State:         tx.State,
+		Amount:        formatAmount(tx.Amount),
+		SourceType:    tx.SourceType,
+		Reason:        reason,
+		OccurredAt:    tx.CreatedAt,
+	}
+	payload, err := json.Marshal(event)
+	if err == nil {
+		err = b.webhooks.Enqueue(ctx, event.Type, event.ID, payload)
+	}
+	if err != nil {
+		b.logger.ErrorContext(ctx, "failed to queue webhook", "event", event.Type, "error", err)
+	}
+}
+
+// HandleCreateWebhook processes POST /webhooks/subscriptions
+func (s *APIServer) HandleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var sub WebhookSubscription
+	if verr := decodeJSONBody(w, r, &sub); verr != nil {
+		writeValidationError(w, verr)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+	defer cancel()
+
+	created, err := s.webhooks.CreateSubscription(ctx, sub)
+	if err != nil {
+		s.writeWebhookError(ctx, w, err)
+		return
+	}
+
+	// the secret is only ever returned here
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// HandleListWebhooks processes GET /webhooks/subscriptions
+func (s *APIServer) HandleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+	defer cancel()
+
+	subs, err := s.webhooks.ListSubscriptions(ctx)
+	if err != nil {
+		s.writeWebhookError(ctx, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subs)
+}
+
+// HandleDeleteWebhook processes DELETE /webhooks/subscriptions/{id}
+func (s *APIServer) HandleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid subscription id", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+	defer cancel()
+
+	if err := s.webhooks.DeleteSubscription(ctx, id); err != nil {
+		s.writeWebhookError(ctx, w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleListDeliveries processes GET /webhooks/deliveries?subscriptionId=&status=&limit=
+func (s *APIServer) HandleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var subscriptionID int64
+	if v := q.Get("subscriptionId"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid subscriptionId", http.StatusBadRequest)
+			return
+		}
+		subscriptionID = id
+	}
+
+	status := q.Get("status")
+	switch status {
+	case "", deliveryPending, deliveryDelivered, deliveryFailed:
+	default:
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+
+	limit := 50
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+	defer cancel()
+
+	deliveries, err := s.webhooks.ListDeliveries(ctx, subscriptionID, status, limit)
+	if err != nil {
+		s.writeWebhookError(ctx, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// HandleRedeliver processes POST /webhooks/deliveries/{id}/redeliver
+func (s *APIServer) HandleRedeliver(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid delivery id", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+	defer cancel()
+
+	if err := s.webhooks.Redeliver(ctx, id); err != nil {
+		s.writeWebhookError(ctx, w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// webhookAdmin refuses requests to the webhook endpoints without the admin
+// bearer token, they expose the signing secrets and make the service call out
+func (s *APIServer) webhookAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		admin := s.webhooks.cfg.AdminToken
+		if !ok || admin == "" || subtle.ConstantTimeCompare([]byte(token), []byte(admin)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *APIServer) writeWebhookError(ctx context.Context, w http.ResponseWriter, err error) {
+	switch {
+	case isTimeout(err):
+		http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case isTransientError(err):
+		s.logger.ErrorContext(ctx, "webhook request failed", "error", err)
+		http.Error(w, "Database temporarily unavailable", http.StatusServiceUnavailable)
+	case errors.Is(err, errInvalidSubscription):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		s.logger.ErrorContext(ctx, "webhook request failed", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAdminToken = "admin-token"
+
+func newTestWebhookService(t *testing.T) (*WebhookService, sqlmock.Sqlmock) {
+	cfg := DefaultWebhookConfig()
+	cfg.AdminToken = testAdminToken
+	// the receivers of the tests listen on loopback
+	cfg.AllowPrivateTargets = true
+	return newTestWebhookServiceWith(t, cfg)
+}
+
+func newTestWebhookServiceWith(t *testing.T, cfg WebhookConfig) (*WebhookService, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return NewWebhookService(db, cfg), mock
+}
+
+// adminRequest is a request to the webhook endpoints carrying the admin token
+func adminRequest(method, target, body string) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req
+}
+
+func TestWebhookSignature(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	now := time.Now().Unix()
+	ts := strconv.FormatInt(now, 10)
+	sig := signWebhook("s3cret", now, body)
+
+	assert.True(t, VerifyWebhookSignature("s3cret", ts, sig, body, time.Minute))
+	assert.False(t, VerifyWebhookSignature("other", ts, sig, body, time.Minute))
+	assert.False(t, VerifyWebhookSignature("s3cret", ts, sig, []byte(`{"id":2}`), time.Minute))
+
+	old := now - 3600
+	assert.False(t, VerifyWebhookSignature("s3cret", strconv.FormatInt(old, 10), signWebhook("s3cret", old, body), body, time.Minute),
+		"stale timestamps must be refused")
+}
+
+func TestCreateSubscription_Validation(t *testing.T) {
+	webhooks, mock := newTestWebhookService(t)
+	ctx := context.Background()
+
+	for _, sub := range []WebhookSubscription{
+		{URL: "ftp://partner.example/hook", EventTypes: []string{EventBalanceChanged}},
+		{URL: "/relative", EventTypes: []string{EventBalanceChanged}},
+		{URL: "https://partner.example/hook"},
+		{URL: "https://partner.example/hook", EventTypes: []string{"user.deleted"}},
+	} {
+		_, err := webhooks.CreateSubscription(ctx, sub)
+		assert.ErrorIs(t, err, errInvalidSubscription, sub.URL)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateSubscription_RefusesInternalTargets(t *testing.T) {
+	webhooks, mock := newTestWebhookServiceWith(t, DefaultWebhookConfig())
+	ctx := context.Background()
+
+	for _, target := range []string{
+		"http://localhost:8080/hook",
+		"http://127.0.0.1/hook",
+		"http://10.1.2.3/hook",
+		"http://192.168.0.10/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+		"http://0.0.0.0/hook",
+	} {
+		_, err := webhooks.CreateSubscription(ctx, WebhookSubscription{URL: target, EventTypes: []string{EventBalanceChanged}})
+		assert.ErrorIs(t, err, errInvalidSubscription, target)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWebhookService_DoesNotDialInternalTargets(t *testing.T) {
+	called := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer receiver.Close()
+
+	// e.g. a public name resolving to loopback, only the dialer sees the address
+	webhooks, mock := newTestWebhookServiceWith(t, DefaultWebhookConfig())
+	expectClaim(mock, receiver.URL, 0)
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = \\$2, attempts = \\$3, last_status_code = \\$4, last_error = \\$5").
+		WithArgs(9, deliveryPending, 1, nil, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	_, err := webhooks.DeliverOnce(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, called)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWebhookRoutesRequireAdminToken(t *testing.T) {
+	webhooks, mock := newTestWebhookService(t)
+	router := NewAPIServer(NewMockStore(), WithWebhooks(webhooks)).Router()
+
+	for _, token := range []string{"", "Bearer wrong", testAdminToken} {
+		req := httptest.NewRequest("GET", "/v1/webhooks/subscriptions", nil)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code, token)
+		assert.Equal(t, "Bearer", rr.Header().Get("WWW-Authenticate"))
+	}
+
+	// without a configured token nobody gets in
+	webhooks, _ = newTestWebhookServiceWith(t, DefaultWebhookConfig())
+	router = NewAPIServer(NewMockStore(), WithWebhooks(webhooks)).Router()
+	req := httptest.NewRequest("GET", "/webhooks/subscriptions", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestHandleCreateWebhook(t *testing.T) {
+	webhooks, mock := newTestWebhookService(t)
+	router := NewAPIServer(NewMockStore(), WithWebhooks(webhooks)).Router()
+
+	mock.ExpectQuery("INSERT INTO webhook_subscriptions").
+		WithArgs("https://partner.example/hook", "balance.changed,transaction.rejected", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(3, time.Now()))
+
+	body := `{"url":"https://partner.example/hook","eventTypes":["balance.changed","transaction.rejected"]}`
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, adminRequest("POST", "/webhooks/subscriptions", body))
+
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var created WebhookSubscription
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+	assert.Equal(t, int64(3), created.ID)
+	assert.Len(t, created.Secret, 64, "a secret is generated when none is given")
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, adminRequest("POST", "/webhooks/subscriptions", `{"url":"nope"}`))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, adminRequest("POST", "/webhooks/subscriptions", `{"url":"https://partner.example/hook","events":["balance.changed"]}`))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "unknown_field", rr.Header().Get("Error-Code"))
+}
+
+func TestWebhookRoutesDisabledByDefault(t *testing.T) {
+	router := NewAPIServer(NewMockStore()).Router()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/webhooks/deliveries", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestHandleListDeliveries(t *testing.T) {
+	webhooks, mock := newTestWebhookService(t)
+	router := NewAPIServer(NewMockStore(), WithWebhooks(webhooks)).Router()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	mock.ExpectQuery("FROM webhook_deliveries WHERE TRUE AND subscription_id = \\$1 AND status = \\$2 ORDER BY id DESC LIMIT \\$3").
+		WithArgs(3, "failed", 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "subscription_id", "event_type", "event_id", "status", "attempts",
+			"last_status_code", "last_error", "next_attempt_at", "created_at", "delivered_at"}).
+			AddRow(9, 3, EventBalanceChanged, "balance.changed:42", "failed", 12, 500, "receiver answered 500 Internal Server Error", now, now, nil))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, adminRequest("GET", "/webhooks/deliveries?subscriptionId=3&status=failed&limit=10", ""))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var deliveries []WebhookDelivery
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &deliveries))
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, 500, *deliveries[0].LastStatusCode)
+	assert.Nil(t, deliveries[0].DeliveredAt)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, adminRequest("GET", "/webhooks/deliveries?status=lost", ""))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestHandleRedeliver(t *testing.T) {
+	webhooks, mock := newTestWebhookService(t)
+	router := NewAPIServer(NewMockStore(), WithWebhooks(webhooks)).Router()
+
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = \\$2, attempts = 0, next_attempt_at = NOW\\(\\)").
+		WithArgs(9, deliveryPending).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE webhook_deliveries SET status").
+		WithArgs(10, deliveryPending).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, adminRequest("POST", "/webhooks/deliveries/9/redeliver", ""))
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, adminRequest("POST", "/webhooks/deliveries/10/redeliver", ""))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWebhookService_PublishEnqueuesBalanceChange(t *testing.T) {
+	webhooks, mock := newTestWebhookService(t)
+
+	mock.ExpectExec("INSERT INTO webhook_deliveries").
+		WithArgs(EventBalanceChanged, "balance.changed:7", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	err := webhooks.Publish(context.Background(), BalanceEvent{ID: 7, Type: EventBalanceChanged, UserID: 1})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestHandleTransaction_QueuesRejectionWebhook(t *testing.T) {
+	webhooks, mock := newTestWebhookService(t)
+	router := NewAPIServer(NewMockStore(), WithWebhooks(webhooks)).Router()
+
+	mock.ExpectExec("INSERT INTO webhook_deliveries").
+		WithArgs(EventTransactionRejected, "transaction.rejected:txn-broke", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	body, _ := json.Marshal(TransactionRequest{State: "lose", Amount: "5.00", TransactionID: "txn-broke"})
+	req := httptest.NewRequest("POST", "/user/1/transaction", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Source-Type", "game")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func expectClaim(mock sqlmock.Sqlmock, url string, attempts int) {
+	mock.ExpectQuery("UPDATE webhook_deliveries d SET next_attempt_at").
+		WithArgs(50, int64(510000)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event_type", "payload", "attempts", "url", "secret"}).
+			AddRow(9, EventBalanceChanged, `{"id":42}`, attempts, url, "s3cret"))
+}
+
+func TestWebhookService_DeliversSignedPayload(t *testing.T) {
+	var received []byte
+	var header http.Header
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+		header = r.Header
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+
+	webhooks, mock := newTestWebhookService(t)
+	expectClaim(mock, receiver.URL, 0)
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = \\$2, attempts = \\$3, last_status_code = \\$4, last_error = NULL, delivered_at = NOW\\(\\)").
+		WithArgs(9, deliveryDelivered, 1, 200).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	sent, err := webhooks.DeliverOnce(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sent)
+
+	assert.Equal(t, `{"id":42}`, string(received))
+	assert.Equal(t, "9", header.Get("Webhook-Id"))
+	assert.Equal(t, EventBalanceChanged, header.Get("Webhook-Event"))
+	assert.True(t, VerifyWebhookSignature("s3cret", header.Get("Webhook-Timestamp"), header.Get("Webhook-Signature"), received, time.Minute))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWebhookService_RetriesThenFails(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	webhooks, mock := newTestWebhookService(t)
+
+	expectClaim(mock, receiver.URL, 0)
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = \\$2, attempts = \\$3, last_status_code = \\$4, last_error = \\$5").
+		WithArgs(9, deliveryPending, 1, 500, "receiver answered 500 Internal Server Error", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	_, err := webhooks.DeliverOnce(context.Background())
+	assert.NoError(t, err)
+
+	expectClaim(mock, receiver.URL, DefaultWebhookConfig().MaxAttempts-1)
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = \\$2, attempts = \\$3, last_status_code = \\$4, last_error = \\$5").
+		WithArgs(9, deliveryFailed, DefaultWebhookConfig().MaxAttempts, 500, sqlmock.AnyArg(), int64(0)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	_, err = webhooks.DeliverOnce(context.Background())
+	assert.NoError(t, err)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}